@@ -0,0 +1,52 @@
+package main
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"sync"
+)
+
+// checked against when there's no such user, so they take as long
+// as a wrong password and can't be told apart
+var (
+	noUserHash []byte
+	noUserOnce sync.Once
+)
+
+// authenticate asks for a username and password before serving
+// anything but health and readiness checks, if the config has any
+// users. Each user's password is a bcrypt hash.
+func authenticate(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cnfLock.RLock()
+		users := cnf.BasicAuthUsers
+		open := r.URL.Path == cnf.HealthPath || r.URL.Path == cnf.ReadyPath
+		cnfLock.RUnlock()
+
+		if len(users) == 0 || open || checkPassword(users, r) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		authFailures.Inc()
+		w.Header().Set("WWW-Authenticate", `Basic realm="stdout2prom"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// checkPassword is whether the request has the username and password
+// of one of the users.
+func checkPassword(users map[string]string, r *http.Request) bool {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	hash, known := users[username]
+	if !known {
+		noUserOnce.Do(func() {
+			noUserHash, _ = bcrypt.GenerateFromPassword([]byte("no such user"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(noUserHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// MetricTest is a line a metric should match, or not, and what it
+// should get from it, run by -test.
+type MetricTest struct {
+	Line         string            `yaml:"line"`
+	ExpectMatch  *bool             `yaml:"expectMatch"`
+	ExpectValue  *float64          `yaml:"expectValue"`
+	ExpectLabels map[string]string `yaml:"expectLabels"`
+}
+
+// testConfig runs the tests in the config file, printing how each
+// went, and returns what to exit with.
+func testConfig(path string) int {
+	c, err := loadConfig(path)
+	if err != nil {
+		fmt.Printf("%s: %v\n", path, err)
+		return 1
+	}
+
+	tests, failed := 0, 0
+	for index := range c.Metrics {
+		metric := &c.Metrics[index]
+		for number, test := range metric.Tests {
+			tests++
+			var got *dryRunMatch
+			if !c.ignores(test.Line) {
+				got = tryMetric(metric, &inputLine{text: test.Line}, nil)
+			}
+
+			problems := test.check(got)
+			if len(problems) == 0 {
+				fmt.Printf("PASS %s test %d\n", metric.Name, number+1)
+				continue
+			}
+			failed++
+			fmt.Printf("FAIL %s test %d, %q\n", metric.Name, number+1, test.Line)
+			for _, problem := range problems {
+				fmt.Printf("  %s\n", problem)
+			}
+		}
+	}
+
+	fmt.Printf("%s: %d of %d tests passed\n", path, tests-failed, tests)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// check says what, if anything, is wrong with what the metric got
+// from the line.
+func (t MetricTest) check(got *dryRunMatch) []string {
+	expectMatch := t.ExpectMatch == nil || *t.ExpectMatch
+	if got == nil {
+		if expectMatch {
+			return []string{"didn't match"}
+		}
+		return nil
+	}
+	if !expectMatch {
+		return []string{fmt.Sprintf("matched, got %s", got.describe())}
+	}
+
+	var problems []string
+	if got.Error != "" {
+		problems = append(problems, fmt.Sprintf("couldn't use the match, %s", got.Error))
+	}
+	if t.ExpectValue != nil && (got.Value == nil || !nearly(*got.Value, *t.ExpectValue)) {
+		problems = append(problems, fmt.Sprintf("expected value %g, got %s", *t.ExpectValue, got.describe()))
+	}
+	names := make([]string, 0, len(t.ExpectLabels))
+	for name := range t.ExpectLabels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value, ok := got.Labels[name]
+		if !ok || value != t.ExpectLabels[name] {
+			problems = append(problems, fmt.Sprintf("expected label %s=%q, got %s", name, t.ExpectLabels[name], got.describe()))
+		}
+	}
+	return problems
+}
+
+// nearly is whether a value is the one expected, give or take the
+// rounding from scaling it.
+func nearly(value, expected float64) bool {
+	return math.Abs(value-expected) <= 1e-9*math.Max(1, math.Abs(expected))
+}
+
+// describe is what was got, for a failed test.
+func (m *dryRunMatch) describe() string {
+	parts := []string{"no value"}
+	if m.Value != nil {
+		parts[0] = fmt.Sprintf("value %g", *m.Value)
+	}
+	names := make([]string, 0, len(m.Labels))
+	for name := range m.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s=%q", name, m.Labels[name]))
+	}
+	return strings.Join(parts, ", ")
+}
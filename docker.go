@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// dockerContainer is a container whose logs we read through the
+// docker engine's API, rather than running it ourselves.
+type dockerContainer struct {
+	name   string
+	client *http.Client
+	tty    bool
+	since  time.Time
+	stdout *io.PipeWriter
+	stderr *io.PipeWriter
+}
+
+// containerInfo is what we need from inspecting a container.
+type containerInfo struct {
+	Name   string `json:"Name"`
+	Config struct {
+		Tty bool `json:"Tty"`
+	} `json:"Config"`
+	State struct {
+		Running bool `json:"Running"`
+	} `json:"State"`
+}
+
+// startDocker reads a container's stdout and stderr in the background
+// through the docker socket, from now on. Whenever the container
+// stops we wait for it to start again and carry on, so it never
+// finishes. If streamLabel is set, a label of that name says which
+// stream each line came from, and if containerLabel is set a label of
+// that name holds the container's name.
+func startDocker(name string, socket string, streamLabel string, containerLabel string) {
+	d := &dockerContainer{
+		name: name,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+		since: time.Now(),
+	}
+
+	info, err := d.inspect()
+	if err != nil {
+		logFatal(nil, "Failed to find container %s, %v", name, err)
+	}
+
+	//
+	// Lines are read from pipes which outlive each attachment, so a
+	// restart doesn't look like the end of the input.
+	//
+	stream := func(out io.Writer, which string) *io.PipeWriter {
+		reader, writer := io.Pipe()
+		fields := prometheus.Labels{}
+		if streamLabel != "" {
+			fields[streamLabel] = which
+		}
+		if containerLabel != "" {
+			fields[containerLabel] = strings.TrimPrefix(info.Name, "/")
+		}
+		go readLines(reader, out, fields)
+		return writer
+	}
+	d.stdout = stream(os.Stdout, "stdout")
+	d.stderr = stream(os.Stderr, "stderr")
+
+	go d.follow()
+}
+
+// follow reads the container's logs for as long as it's running,
+// then waits for it to run again, over and over.
+func (d *dockerContainer) follow() {
+	attached := false
+	for {
+		info, err := d.inspect()
+		if err != nil || !info.State.Running {
+			if err != nil && *debug {
+				logDebug(nil, "Failed to inspect container %s, %v", d.name, err)
+			}
+			time.Sleep(time.Second)
+			continue
+		}
+		if attached {
+			dockerReattaches.Inc()
+			logInfo(nil, "Container %s is running again, reattaching", d.name)
+		}
+		attached = true
+
+		d.tty = info.Config.Tty
+		err = d.logs()
+		if err != nil {
+			logError(nil, "Lost the logs of container %s, %v", d.name, err)
+		} else if *debug {
+			logDebug(nil, "Container %s stopped", d.name)
+		}
+
+		// it can take a moment for the engine to notice it's stopped
+		time.Sleep(time.Second)
+	}
+}
+
+// inspect asks the engine about the container.
+func (d *dockerContainer) inspect() (containerInfo, error) {
+	var info containerInfo
+	resp, err := d.client.Get("http://docker/containers/" + url.PathEscape(d.name) + "/json")
+	if err != nil {
+		return info, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return info, fmt.Errorf("docker said %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	return info, err
+}
+
+// logs reads the container's logs since we last did until it stops.
+func (d *dockerContainer) logs() error {
+	query := url.Values{
+		"follow": {"1"},
+		"stdout": {"1"},
+		"stderr": {"1"},
+		"since":  {fmt.Sprintf("%d.%09d", d.since.Unix(), d.since.Nanosecond())},
+	}
+	resp, err := d.client.Get("http://docker/containers/" + url.PathEscape(d.name) + "/logs?" + query.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("docker said %s", resp.Status)
+	}
+	defer func() {
+		d.since = time.Now()
+	}()
+
+	// a container with a terminal only has the one stream
+	if d.tty {
+		_, err = io.Copy(d.stdout, resp.Body)
+		return err
+	}
+	return d.demultiplex(bufio.NewReader(resp.Body))
+}
+
+// demultiplex splits the engine's log stream back into stdout and
+// stderr. Each frame has an 8 byte header, the first byte being the
+// stream and the last four the length of what follows.
+func (d *dockerContainer) demultiplex(reader io.Reader) error {
+	header := make([]byte, 8)
+	for {
+		_, err := io.ReadFull(reader, header)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		out := d.stdout
+		if header[0] == 2 {
+			out = d.stderr
+		}
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		_, err = io.CopyN(out, reader, size)
+		if err != nil {
+			return err
+		}
+	}
+}
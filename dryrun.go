@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"os"
+	"sync"
+	"text/tabwriter"
+)
+
+// dryRunMatch is what gets printed for each match in a dry run.
+type dryRunMatch struct {
+	Metric string            `json:"metric"`
+	Value  *float64          `json:"value,omitempty"`
+	Labels prometheus.Labels `json:"labels,omitempty"`
+	Error  string            `json:"error,omitempty"`
+}
+
+var dryRunOutput io.Writer = os.Stderr
+
+// what a dry run has seen so far, for the summary at the end
+var (
+	dryRunLock    sync.Mutex
+	dryRunLines   int
+	dryRunMatches = map[string]int{}
+	dryRunErrors  = map[string]int{}
+)
+
+// dryRunLine runs a line against the metrics and prints what would
+// have been recorded to stderr, one line per match, or as JSON with
+// -dry-run-format json. Nothing is registered, so this is safe for
+// trying out new regexes.
+func dryRunLine(line string, out io.Writer, fields prometheus.Labels) {
+	cnfLock.RLock()
+	defer cnfLock.RUnlock()
+	dryRunLock.Lock()
+	defer dryRunLock.Unlock()
+
+	dryRunLines++
+	if cnf.ignores(line) {
+		return
+	}
+	in := &inputLine{text: line}
+	for index := range cnf.Metrics {
+		metric := &cnf.Metrics[index]
+		match := tryMetric(metric, in, fields)
+		if match == nil {
+			continue
+		}
+
+		dryRunMatches[metric.Name]++
+		if match.Error != "" {
+			dryRunErrors[metric.Name]++
+		}
+		if *dryRunFmt == "json" {
+			json.NewEncoder(dryRunOutput).Encode(match)
+		} else if match.Error != "" {
+			fmt.Fprintf(dryRunOutput, "line %d: %s %s, error: %s\n",
+				dryRunLines, match.Metric, match.describe(), match.Error)
+		} else {
+			fmt.Fprintf(dryRunOutput, "line %d: %s %s\n",
+				dryRunLines, match.Metric, match.describe())
+		}
+		if metric.Stop {
+			break
+		}
+	}
+}
+
+// dryRunSummary prints how many lines each metric matched, and how
+// many of those it couldn't use, at the end of a dry run.
+func dryRunSummary() {
+	cnfLock.RLock()
+	defer cnfLock.RUnlock()
+	dryRunLock.Lock()
+	defer dryRunLock.Unlock()
+
+	fmt.Fprintf(dryRunOutput, "\nLines read: %d\n", dryRunLines)
+	table := tabwriter.NewWriter(dryRunOutput, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(table, "METRIC\tMATCHES\tERRORS")
+	for _, metric := range cnf.Metrics {
+		fmt.Fprintf(table, "%s\t%d\t%d\n", metric.Name,
+			dryRunMatches[metric.Name], dryRunErrors[metric.Name])
+	}
+	table.Flush()
+}
+
+// tryMetric is what the metric would record from the line without
+// recording it, or nil if the line doesn't match.
+func tryMetric(metric *Metric, in *inputLine, fields prometheus.Labels) *dryRunMatch {
+	result, groups := metric.match(in)
+	if len(result) == 0 {
+		return nil
+	}
+	if metric.Excluded != nil && metric.Excluded.MatchString(in.text) {
+		return nil
+	}
+
+	match := &dryRunMatch{Metric: metric.Name}
+	if metric.Value != "" {
+		value, err := getValue(metric.Value,
+			groups,
+			result,
+			*metric.Scale,
+			metric.Offset,
+			metric.Min,
+			metric.Max)
+		if err != nil {
+			match.Error = err.Error()
+		} else {
+			if metric.Negate != nil && metric.Negate.MatchString(in.text) {
+				value = -value
+			}
+			match.Value = &value
+		}
+	}
+	if len(metric.Labels) > 0 {
+		labels, err := getLabels(metric.Labels,
+			groups,
+			result,
+			fields,
+			metric.Rewrite,
+			metric.Allowed)
+		if err != nil {
+			match.Error = err.Error()
+		}
+		match.Labels = labels
+	}
+	return match
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+)
+
+// childProcess is a command we've started whose output we read
+// instead of stdin.
+type childProcess struct {
+	cmd      *exec.Cmd
+	exitCode int
+}
+
+// startChild runs the command with its stdout and stderr both fed
+// through the metrics and replicated to ours. finished is closed
+// once it has exited and everything it wrote has been read. If
+// streamLabel is set, a label of that name says which stream each
+// line came from.
+func startChild(args []string, streamLabel string, finished chan struct{}) *childProcess {
+	child := &childProcess{cmd: exec.Command(args[0], args[1:]...)}
+	child.cmd.Stdin = os.Stdin
+
+	stdout, err := child.cmd.StdoutPipe()
+	if err != nil {
+		logFatal(nil, "Failed to attach to stdout of %s, %v", args[0], err)
+	}
+	stderr, err := child.cmd.StderrPipe()
+	if err != nil {
+		logFatal(nil, "Failed to attach to stderr of %s, %v", args[0], err)
+	}
+
+	err = child.cmd.Start()
+	if err != nil {
+		logFatal(nil, "Failed to start %s, %v", args[0], err)
+	}
+	if *debug {
+		logDebug(nil, "Started %s, pid %d", args[0], child.cmd.Process.Pid)
+	}
+
+	var streams sync.WaitGroup
+	stream := func(reader io.Reader, out io.Writer, name string) {
+		defer streams.Done()
+		var fields prometheus.Labels
+		if streamLabel != "" {
+			fields = prometheus.Labels{streamLabel: name}
+		}
+		readLines(reader, out, fields)
+	}
+	streams.Add(2)
+	go stream(stdout, os.Stdout, "stdout")
+	go stream(stderr, os.Stderr, "stderr")
+
+	go func() {
+		//
+		// Everything has to be read before waiting, as Wait
+		// closes the pipes.
+		//
+		streams.Wait()
+		err := child.cmd.Wait()
+		child.exitCode = exitCode(err)
+		logInfo(nil, "%s exited with %d", args[0], child.exitCode)
+		close(finished)
+	}()
+
+	return child
+}
+
+// signal passes a signal we caught on to the child.
+func (c *childProcess) signal(sig os.Signal) {
+	if *debug {
+		logDebug(nil, "Passing %v on to pid %d", sig, c.cmd.Process.Pid)
+	}
+	err := c.cmd.Process.Signal(sig)
+	if err != nil {
+		logError(nil, "Failed to pass %v on, %v", sig, err)
+	}
+}
+
+// exitCode turns the result of waiting for a command into an exit
+// code the way a shell would.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return 1
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return 1
+	}
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
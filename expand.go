@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ${VAR} or ${VAR:-default}
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnv replaces references to environment variables in the
+// config with their values, or the default if they're unset or empty.
+// Every variable that's unset without a default is listed in the
+// error.
+func expandEnv(data []byte) ([]byte, error) {
+	var missing []string
+	seen := map[string]bool{}
+	expanded := envReference.ReplaceAllFunc(data, func(reference []byte) []byte {
+		parts := envReference.FindSubmatch(reference)
+		name := string(parts[1])
+		value, ok := os.LookupEnv(name)
+		if ok && value != "" {
+			return []byte(value)
+		}
+		if parts[2] != nil {
+			return parts[3]
+		}
+		if !ok {
+			if !seen[name] {
+				missing = append(missing, name)
+				seen[name] = true
+			}
+		}
+		return nil
+	})
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("environment variables %s aren't set", strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// patternLibrary is named regexes that a metric's regexes can use as
+// %{NAME}, or %{NAME:group} to capture it as a named group, like grok.
+type patternLibrary map[string]string
+
+// the patterns there always are, a patternsFile can add more or
+// replace these
+var basePatterns = patternLibrary{
+	"INT":          `[+-]?\d+`,
+	"NUMBER":       `[+-]?(?:\d+(?:\.\d*)?|\.\d+)(?:[eE][+-]?\d+)?`,
+	"WORD":         `\b\w+\b`,
+	"NOTSPACE":     `\S+`,
+	"DATA":         `.*?`,
+	"GREEDYDATA":   `.*`,
+	"QUOTEDSTRING": `"(?:[^"\\]|\\.)*"`,
+	"IPV4":         `(?:(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)\.){3}(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)`,
+	"IPV6":         `(?:[0-9A-Fa-f]{0,4}:){2,7}(?:%{IPV4}|[0-9A-Fa-f]{0,4})`,
+	"IP":           `%{IPV6}|%{IPV4}`,
+	"HTTPDATE":     `\d{2}/[A-Z][a-z]{2}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}`,
+	"LOGLEVEL":     `(?i:trace|debug|info|notice|warn(?:ing)?|err(?:or)?|crit(?:ical)?|fatal|severe|emerg(?:ency)?|alert)`,
+	"UUID":         `[A-Fa-f0-9]{8}-(?:[A-Fa-f0-9]{4}-){3}[A-Fa-f0-9]{12}`,
+
+	// Apache's and nginx's access logs, with nginx's request_time if
+	// it's been added to the end. A request that isn't a method, path
+	// and protocol, ie from a port scanner, still matches.
+	"COMMONLOG":   `%{NOTSPACE:remote_addr} %{NOTSPACE:remote_ident} %{NOTSPACE:remote_user} \[%{HTTPDATE:time_local}\] "(?:%{WORD:method} %{NOTSPACE:path}(?: %{NOTSPACE:protocol})?|(?:[^"\\]|\\.)*)" (?P<status>\d{3}) (?:%{INT:bytes}|-)`,
+	"COMBINEDLOG": `%{COMMONLOG} "(?P<referer>(?:[^"\\]|\\.)*)" "(?P<user_agent>(?:[^"\\]|\\.)*)"(?: %{NUMBER:request_time})?`,
+}
+
+// the regex a metric with format combined has
+const combinedRegex = `^%{COMBINEDLOG}`
+
+// %{NAME}, %{NAME:group} or %{NAME:group:type}, the type being
+// ignored as values are always floats
+var patternReference = regexp.MustCompile(`%\{(\w+)(?::(\w+))?(?::\w+)?\}`)
+
+// loadPatterns is the base patterns along with those in the file, if
+// there is one. Each line of it is a name and its regex, ie
+// `STATUS [1-5]\d\d`, blank lines and those starting with # are
+// skipped.
+func loadPatterns(path string) (patternLibrary, error) {
+	patterns := patternLibrary{}
+	for name, pattern := range basePatterns {
+		patterns[name] = pattern
+	}
+	if path == "" {
+		return patterns, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	number := 0
+	for scanner.Scan() {
+		number++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		space := strings.IndexAny(line, " \t")
+		if space == -1 || !labelNameRE.MatchString(line[:space]) {
+			return nil, fmt.Errorf("line %d of %s isn't a name and a regex", number, path)
+		}
+		patterns[line[:space]] = strings.TrimSpace(line[space:])
+	}
+	return patterns, scanner.Err()
+}
+
+// expand replaces the patterns the regex uses with their regexes.
+func (p patternLibrary) expand(regex string) (string, error) {
+	return p.expandWithin(regex, nil)
+}
+
+// expandWithin is expand for the regex of a pattern used by those in
+// within, which it can't use itself.
+func (p patternLibrary) expandWithin(regex string, within []string) (string, error) {
+	var failed error
+	expanded := patternReference.ReplaceAllStringFunc(regex, func(reference string) string {
+		if failed != nil {
+			return ""
+		}
+		parts := patternReference.FindStringSubmatch(reference)
+		name, group := parts[1], parts[2]
+
+		pattern, ok := p[name]
+		if !ok {
+			failed = fmt.Errorf("unknown pattern %s", name)
+			return ""
+		}
+		for _, outer := range within {
+			if outer == name {
+				failed = fmt.Errorf("pattern %s uses itself, %s", name,
+					strings.Join(append(within, name), " uses "))
+				return ""
+			}
+		}
+		inner, err := p.expandWithin(pattern, append(within, name))
+		if err != nil {
+			failed = err
+			return ""
+		}
+
+		if group != "" {
+			return "(?P<" + group + ">" + inner + ")"
+		}
+		return "(?:" + inner + ")"
+	})
+	return expanded, failed
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// gzipInput is input that might be gzipped, ie a rotated log being
+// replayed. Whether it is is worked out the first time it's read,
+// from the gzip magic number.
+type gzipInput struct {
+	name   string
+	source io.Reader
+	reader io.Reader
+	zipped *compressedReader
+}
+
+// compressedReader counts the gzipped bytes read, so a corrupt stream
+// can say where it went wrong. It's a ByteReader so gzip doesn't read
+// ahead of what it's used.
+type compressedReader struct {
+	*bufio.Reader
+	offset int64
+}
+
+// newGzipInput reads from source, gunzipping it if need be. name is
+// what to call it if it's corrupt.
+func newGzipInput(name string, source io.Reader) *gzipInput {
+	return &gzipInput{name: name, source: source}
+}
+
+func (g *gzipInput) Read(p []byte) (int, error) {
+	if g.reader == nil {
+		buffered := bufio.NewReader(g.source)
+		magic, _ := buffered.Peek(2)
+		if len(magic) < 2 || magic[0] != 0x1f || magic[1] != 0x8b {
+			g.reader = buffered
+			return g.reader.Read(p)
+		}
+
+		g.zipped = &compressedReader{Reader: buffered}
+		unzipped, err := gzip.NewReader(g.zipped)
+		if err != nil {
+			return 0, g.corrupt(err)
+		}
+		g.reader = unzipped
+	}
+
+	n, err := g.reader.Read(p)
+	if err != nil && err != io.EOF && g.zipped != nil {
+		err = g.corrupt(err)
+	}
+	return n, err
+}
+
+// corrupt says where the gzipped input went wrong.
+func (g *gzipInput) corrupt(err error) error {
+	return fmt.Errorf("%s is corrupt at byte %d of the gzipped input, %v", g.name, g.zipped.offset, err)
+}
+
+func (c *compressedReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.offset += int64(n)
+	compressedBytes.Add(float64(n))
+	return n, err
+}
+
+func (c *compressedReader) ReadByte() (byte, error) {
+	b, err := c.Reader.ReadByte()
+	if err == nil {
+		c.offset++
+		compressedBytes.Inc()
+	}
+	return b, err
+}
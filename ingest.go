@@ -0,0 +1,83 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ingestSummary is what we reply to lines being posted with.
+type ingestSummary struct {
+	Lines   int `json:"lines"`
+	Matched int `json:"matched"`
+}
+
+// ingestHandler runs lines posted to it through the metrics, for
+// things that can only speak HTTP. The body is plain text, a line at
+// a time, and can be gzipped.
+func ingestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST lines to ingest them", http.StatusMethodNotAllowed)
+		return
+	}
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || mediaType != "text/plain" {
+			http.Error(w, "Lines must be text/plain", http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+
+	cnfLock.RLock()
+	limit := cnf.IngestMaxBytes
+	cnfLock.RUnlock()
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		unzipped, err := gzip.NewReader(body)
+		if err != nil {
+			http.Error(w, "Failed to gunzip, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer unzipped.Close()
+		body = unzipped
+	}
+
+	//
+	// The limit is on the lines once they've been gunzipped, so a small
+	// gzipped body can't turn into a huge one. None of the lines are
+	// used unless they all fit.
+	//
+	data, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		http.Error(w, "Failed to read lines, "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if int64(len(data)) > limit {
+		http.Error(w, "Too many lines", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var summary ingestSummary
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			continue
+		}
+		summary.Lines++
+		processing.Lock()
+		if recordLine(line, os.Stdout, nil) {
+			summary.Matched++
+		}
+		processing.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
@@ -0,0 +1,625 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lineHandler does something with a line read, fields being labels
+// that came along with it.
+type lineHandler func(line string, out io.Writer, fields prometheus.Labels)
+
+// handleLine is what's done with each line read, a dry run swaps it
+// for one that doesn't record anything.
+var handleLine lineHandler = processLine
+
+// startReading starts reading lines from whatever we've been told
+// to, closing finished when there are no more. If that's a command,
+// it's returned so it can be signalled and its exit code passed on.
+func startReading(finished chan struct{}) *childProcess {
+	checkMultiline()
+	if flag.NArg() > 0 {
+		return startChild(flag.Args(), cnf.StreamLabel, finished)
+	}
+	if *listenIn != "" {
+		startListener(*listenIn, cnf.RemoteLabel, handleLine, finished)
+	} else if *syslogIn != "" {
+		startListener(*syslogIn, cnf.RemoteLabel, syslogLine, finished)
+	} else if *journal {
+		startJournal(*units)
+	} else if *container != "" {
+		startDocker(*container, *dockerSock, cnf.StreamLabel, cnf.ContainerLabel)
+	} else if *fifo != "" {
+		startFifo(*fifo, cnf.FileLabel, finished)
+	} else {
+		startInput(*input, *follow, cnf.FileLabel, finished)
+	}
+	return nil
+}
+
+// startInput reads lines from the input in the background, closing
+// finished when there are no more. The input is stdin for "-", or
+// else a file, or a glob of files which are all read at once. If
+// fileLabel is set, a label of that name holds where each line came
+// from.
+func startInput(name string, follow bool, fileLabel string, finished chan struct{}) {
+	if strings.ContainsAny(name, "*?[") {
+		go readGlob(name, follow, fileLabel, finished)
+		return
+	}
+
+	// stdin doesn't have a name
+	var fields prometheus.Labels
+	if fileLabel != "" && name != "-" {
+		fields = prometheus.Labels{fileLabel: name}
+	}
+	reader := openInput(name, follow)
+	go func() {
+		readLines(reader, os.Stdout, fields)
+		close(finished)
+	}()
+}
+
+// startFifo reads lines from a named pipe in the background. When
+// the writer closes it we wait for the next one rather than
+// finishing, so finished is only closed if the pipe can't be read.
+func startFifo(name string, fileLabel string, finished chan struct{}) {
+	info, err := os.Stat(name)
+	if err != nil {
+		logFatal(nil, "Failed to open fifo %s, %v", name, err)
+	}
+	if info.Mode()&os.ModeNamedPipe == 0 {
+		logFatal(nil, "Failed to open fifo %s, not a named pipe", name)
+	}
+
+	var fields prometheus.Labels
+	if fileLabel != "" {
+		fields = prometheus.Labels{fileLabel: name}
+	}
+	go func() {
+		readLines(&fifoReader{name: name}, os.Stdout, fields)
+		close(finished)
+	}()
+}
+
+// openInput opens whatever we've been asked to read lines from, "-"
+// being stdin.
+func openInput(name string, follow bool) io.Reader {
+	if name == "-" {
+		return newGzipInput("stdin", os.Stdin)
+	}
+
+	reader, err := openFile(name, follow, !*fromStart)
+	if err != nil {
+		logFatal(nil, "Failed to open input %s, %v", name, err)
+	}
+	return reader
+}
+
+// openFile opens a file for reading, following it if asked to.
+// atEnd skips what's already in there, like tail. A file that isn't
+// being followed can be gzipped.
+func openFile(name string, follow bool, atEnd bool) (io.Reader, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if !follow {
+		return newGzipInput(name, f), nil
+	}
+
+	//
+	// Carry on from where we were last time if we know, otherwise
+	// start at the end or the beginning as asked.
+	//
+	offset, resumed := int64(0), false
+	if *posFile != "" {
+		offset, resumed = resumePosition(name, f)
+	}
+	if resumed {
+		_, err = f.Seek(offset, io.SeekStart)
+	} else if atEnd {
+		offset, err = f.Seek(0, io.SeekEnd)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	reader := &followReader{name: name, file: f, inode: inode(info), start: offset}
+	positionLock.Lock()
+	followed[name] = reader
+	positionLock.Unlock()
+	return reader, nil
+}
+
+// readGlob reads every file matching the pattern at once. When
+// following, the pattern is looked at again every so often and any
+// new files are read from the start, otherwise finished is closed
+// once all the files have been read.
+func readGlob(pattern string, follow bool, fileLabel string, finished chan struct{}) {
+	var lock sync.Mutex
+	var files sync.WaitGroup
+	reading := map[string]bool{}
+	atEnd := !*fromStart
+
+	for {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			logFatal(nil, "Bad input pattern %s, %v", pattern, err)
+		}
+
+		for _, name := range matches {
+			lock.Lock()
+			already := reading[name]
+			lock.Unlock()
+			if already {
+				continue
+			}
+
+			reader, err := openFile(name, follow, atEnd)
+			if err != nil {
+				logError(nil, "Failed to open input %s, %v", name, err)
+				continue
+			}
+			// if it goes away, it's up to the glob to find it again
+			if followed, ok := reader.(*followReader); ok {
+				followed.giveUp = *rescan
+			}
+			if *debug {
+				logDebug(nil, "Reading %s", name)
+			}
+
+			var fields prometheus.Labels
+			if fileLabel != "" {
+				fields = prometheus.Labels{fileLabel: name}
+			}
+
+			lock.Lock()
+			reading[name] = true
+			lock.Unlock()
+			filesTailed.Inc()
+			files.Add(1)
+			go func(name string) {
+				defer files.Done()
+				readLines(reader, os.Stdout, fields)
+				filesTailed.Dec()
+				lock.Lock()
+				delete(reading, name)
+				lock.Unlock()
+			}(name)
+		}
+
+		if !follow {
+			files.Wait()
+			close(finished)
+			return
+		}
+
+		// files that turn up later are new, so read all of them
+		atEnd = false
+		time.Sleep(*rescan)
+	}
+}
+
+// newScanner splits the input into lines, or records ending with the
+// delimiter if it isn't nil, dropping any that are too long. The
+// splitter knows how much of the input has been used.
+func newScanner(reader io.Reader, delimiter []byte) (*bufio.Scanner, *lineSplitter) {
+	longest := cnf.MaxLineLength
+	if *maxLine > 0 {
+		longest = *maxLine
+	}
+	// room for the longest line and what ends it, maybe with a \r
+	room := longest + 2
+	if delimiter != nil {
+		room = longest + len(delimiter) + 1
+	}
+	initial := 64 * 1024
+	if room < initial {
+		initial = room
+	}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, initial), room)
+	splitter := &lineSplitter{max: longest, room: room, delimiter: delimiter}
+	scanner.Split(splitter.split)
+	return scanner, splitter
+}
+
+// how many readers there are, and how many of those are waiting for
+// more input, having processed everything they've been given
+var (
+	readersActive  int32
+	readersWaiting int32
+)
+
+// waitingReader notes when a reader is waiting for more input.
+type waitingReader struct {
+	reader io.Reader
+}
+
+func (w waitingReader) Read(p []byte) (int, error) {
+	atomic.AddInt32(&readersWaiting, 1)
+	defer atomic.AddInt32(&readersWaiting, -1)
+	return w.reader.Read(p)
+}
+
+// what the lines read end with, from -delimiter, nil for a newline
+var recordEnd []byte
+
+// readLines processes each line from the reader in turn, replicating
+// them to out. fields are labels that go along with every line. With
+// multiline set it's each record of lines instead, and with
+// -delimiter the lines end with that rather than a newline.
+func readLines(reader io.Reader, out io.Writer, fields prometheus.Labels) {
+	if cnf.Multiline == nil {
+		readDelimited(reader, out, fields, handleLine, recordEnd)
+		return
+	}
+
+	joiner := newRecordJoiner(cnf.Multiline, cnf.multiline, func(record string) {
+		handleLine(record, out, fields)
+	})
+	readDelimited(reader, out, fields, joiner.add, recordEnd)
+	processing.Lock()
+	joiner.stop()
+	processing.Unlock()
+}
+
+// readLinesWith is readLines with something else done with each line.
+// They're always lines, for input that's never anything else.
+func readLinesWith(reader io.Reader, out io.Writer, fields prometheus.Labels, handle lineHandler) {
+	readDelimited(reader, out, fields, handle, nil)
+}
+
+// readDelimited is readLinesWith for records ending with the
+// delimiter, or lines if it's nil.
+func readDelimited(reader io.Reader, out io.Writer, fields prometheus.Labels, handle lineHandler, delimiter []byte) {
+	atomic.AddInt32(&readersActive, 1)
+	defer atomic.AddInt32(&readersActive, -1)
+
+	scanner, splitter := newScanner(waitingReader{reader}, delimiter)
+	followed, _ := reader.(*followReader)
+	for scanner.Scan() {
+		processing.Lock()
+		handle(scanner.Text(), out, fields)
+		if followed != nil {
+			followed.processed(splitter.used)
+		}
+		processing.Unlock()
+	}
+	err := scanner.Err()
+	switch err {
+	case nil:
+	case bufio.ErrTooLong, bufio.ErrNegativeAdvance, bufio.ErrAdvanceTooFar, bufio.ErrBadReadCount:
+		// the scanner gave up rather than the input going wrong
+		scannerErrors.Inc()
+		logError(nil, "Failed splitting input into lines, %v", err)
+	default:
+		readErrors.Inc()
+		logError(nil, "Failed reading input, %v", err)
+	}
+}
+
+// stopReading processes the input that has already been read or is
+// waiting to be, then stops any more being processed. Another signal
+// gives up on that, returning false.
+func stopReading(signals chan os.Signal) bool {
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+	busy := time.After(5 * time.Second)
+
+	//
+	// A reader waiting for more has got to the end of what there is
+	// and processed every whole line of it.
+	//
+idle:
+	for atomic.LoadInt32(&readersWaiting) < atomic.LoadInt32(&readersActive) {
+		select {
+		case <-tick.C:
+		case <-busy:
+			logWarn(nil, "Input is still coming, stopping anyway")
+			break idle
+		case sig := <-signals:
+			logInfo(nil, "Caught %v again, not waiting", sig)
+			return false
+		}
+	}
+
+	// the line being processed might be stuck writing to stdout
+	locked := make(chan struct{})
+	go func() {
+		processing.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return true
+	case sig := <-signals:
+		logInfo(nil, "Caught %v again, not waiting", sig)
+		return false
+	}
+}
+
+// followReader keeps reading a file after reaching the end of it,
+// waiting for more to be written like tail -F. If the file is
+// rotated or truncated it starts again from the beginning of the new
+// one. If giveUp is set and the file has been gone for that long,
+// we stop.
+//
+// It also keeps track of how far through the file the lines that
+// have been processed go, so we can carry on from there next time.
+type followReader struct {
+	name   string
+	file   *os.File
+	giveUp time.Duration
+	gone   time.Time
+
+	lock  sync.Mutex
+	inode uint64
+	start int64 // offset we started reading the file at
+	base  int64 // bytes used from earlier files when we got to this one
+	used  int64 // bytes used from all files, as of the last line processed
+}
+
+func (f *followReader) Read(p []byte) (int, error) {
+	for {
+		n, err := f.file.Read(p)
+		if err == io.EOF && n == 0 {
+			time.Sleep(250 * time.Millisecond)
+			if !f.checkRotated() {
+				f.stop()
+				return 0, io.EOF
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// stop finishes with a file that has gone away for good.
+func (f *followReader) stop() {
+	if *debug {
+		logDebug(nil, "%s has gone, stopping", f.name)
+	}
+	positionLock.Lock()
+	if followed[f.name] == f {
+		delete(followed, f.name)
+	}
+	positionLock.Unlock()
+	f.file.Close()
+}
+
+// checkRotated reopens the file if a different one, going by inode,
+// is now at our path, or rewinds if ours has been truncated. It
+// returns false once the file has been gone for longer than giveUp.
+func (f *followReader) checkRotated() bool {
+	// rotated away and the new one not there yet
+	latest, err := os.Stat(f.name)
+	if err != nil {
+		if f.giveUp == 0 {
+			return true
+		}
+		if f.gone.IsZero() {
+			f.gone = time.Now()
+		}
+		return time.Since(f.gone) < f.giveUp
+	}
+	f.gone = time.Time{}
+
+	current, err := f.file.Stat()
+	if err != nil {
+		return true
+	}
+
+	if !os.SameFile(latest, current) {
+		file, err := os.Open(f.name)
+		if err != nil {
+			logError(nil, "Failed to reopen %s, %v", f.name, err)
+			return true
+		}
+		if *debug {
+			logDebug(nil, "%s was rotated, reopening", f.name)
+		}
+		f.file.Close()
+		f.file = file
+		f.restart(inode(latest))
+		return true
+	}
+
+	offset, err := f.file.Seek(0, io.SeekCurrent)
+	if err == nil && latest.Size() < offset {
+		if *debug {
+			logDebug(nil, "%s was truncated, starting again", f.name)
+		}
+		f.file.Seek(0, io.SeekStart)
+		f.restart(f.inode)
+	}
+	return true
+}
+
+// restart notes we're now at the beginning of a file. By the time
+// we've got to the end of the last one every whole line in it has
+// been processed.
+func (f *followReader) restart(inode uint64) {
+	f.lock.Lock()
+	f.inode = inode
+	f.start = 0
+	f.base = f.used
+	f.lock.Unlock()
+}
+
+// processed notes that lines up to used bytes into the input have
+// been dealt with.
+func (f *followReader) processed(used int64) {
+	f.lock.Lock()
+	f.used = used
+	f.lock.Unlock()
+}
+
+// position is how far into the current file has been processed.
+func (f *followReader) position() filePosition {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return filePosition{Inode: f.inode, Offset: f.start + f.used - f.base}
+}
+
+// fifoReader reads from a named pipe, opening it again whenever the
+// writer closes it so we never see the end of it. A writer that
+// doesn't finish its last line has it finished for them, rather
+// than it being stuck on the front of the next writer's first line.
+type fifoReader struct {
+	name    string
+	file    *os.File
+	partial bool
+}
+
+func (f *fifoReader) Read(p []byte) (int, error) {
+	for {
+		//
+		// Opening blocks until there's something writing to it.
+		//
+		if f.file == nil {
+			file, err := os.Open(f.name)
+			if err != nil {
+				return 0, err
+			}
+			f.file = file
+		}
+
+		n, err := f.file.Read(p)
+		if err == io.EOF && n == 0 {
+			if *debug {
+				logDebug(nil, "%s was closed, reopening", f.name)
+			}
+			f.file.Close()
+			f.file = nil
+			fifoReopens.Inc()
+			if f.partial && len(p) > 0 {
+				f.partial = false
+				return copy(p, lineEnd()), nil
+			}
+			continue
+		}
+		if n > 0 {
+			f.partial = !bytes.HasSuffix(p[:n], lineEnd())
+		}
+		return n, err
+	}
+}
+
+// lineSplitter splits lines like bufio.ScanLines, but a line longer
+// than max is dropped rather than stopping the scanner dead. With a
+// delimiter it splits on that instead.
+type lineSplitter struct {
+	max       int
+	room      int
+	delimiter []byte
+	dropping  bool
+	used      int64
+}
+
+func (l *lineSplitter) split(data []byte, atEOF bool) (int, []byte, error) {
+	advance, token, err := l.splitLine(data, atEOF)
+	l.used += int64(advance)
+	return advance, token, err
+}
+
+func (l *lineSplitter) splitLine(data []byte, atEOF bool) (int, []byte, error) {
+	//
+	// Throw away the rest of a long line, up to and including the
+	// newline at the end of it.
+	//
+	end := l.delimiter
+	if end == nil {
+		end = []byte{'\n'}
+	}
+	if l.dropping {
+		i := bytes.Index(data, end)
+		if i < 0 {
+			// keep what might be the start of the delimiter
+			keep := len(end) - 1
+			if keep > len(data) {
+				keep = len(data)
+			}
+			return len(data) - keep, nil, nil
+		}
+		l.dropping = false
+		return i + len(end), nil, nil
+	}
+
+	var advance int
+	var token []byte
+	var err error
+	if l.delimiter == nil {
+		advance, token, err = bufio.ScanLines(data, atEOF)
+	} else if i := bytes.Index(data, end); i >= 0 {
+		advance, token = i+len(end), data[:i]
+	} else if atEOF && len(data) > 0 {
+		advance, token = len(data), data
+	}
+	if advance == 0 && token == nil && err == nil && len(data) >= l.room {
+		l.tooLong()
+		l.dropping = true
+		return len(data), nil, nil
+	}
+
+	// a whole line can still be too long if it fitted in the buffer
+	if len(token) > l.max {
+		l.tooLong()
+		return advance, nil, nil
+	}
+	return advance, token, err
+}
+
+// tooLong counts a line being dropped for being too long.
+func (l *lineSplitter) tooLong() {
+	longLines.Inc()
+	if *debug {
+		logDebug(nil, "Dropping line longer than %d bytes", l.max)
+	}
+}
+
+// lineEnd is what the input's lines end with.
+func lineEnd() []byte {
+	if recordEnd != nil {
+		return recordEnd
+	}
+	return []byte{'\n'}
+}
+
+// parseDelimiter turns -delimiter into the bytes it means, nil for a
+// newline. As NUL can't be given on the command line "\0" means it,
+// as well as the escapes in a Go string, ie "\x1e" or "\t".
+func parseDelimiter(delimiter string) ([]byte, error) {
+	switch delimiter {
+	case "", "\\n":
+		return nil, nil
+	case "\\0":
+		return []byte{0}, nil
+	}
+	unquoted, err := strconv.Unquote(`"` + strings.Replace(delimiter, `"`, `\"`, -1) + `"`)
+	if err != nil {
+		return nil, fmt.Errorf("%q isn't a delimiter, %v", delimiter, err)
+	}
+	if unquoted == "\n" {
+		return nil, nil
+	}
+	return []byte(unquoted), nil
+}
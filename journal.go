@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// the journal fields metrics can use in their labels
+var journalFields = []string{"_SYSTEMD_UNIT", "PRIORITY", "SYSLOG_IDENTIFIER", "_HOSTNAME"}
+
+// how long to wait before running journalctl again, at first and at
+// most
+const (
+	journalBackoff    = time.Second
+	journalBackoffMax = time.Minute
+)
+
+// journalReader follows the journal with journalctl, carrying on
+// from the last entry it saw whenever journalctl has to be run again.
+type journalReader struct {
+	units  []string
+	cursor string
+}
+
+// startJournal follows the systemd journal in the background, only
+// for the given units if there are any. It never finishes, if we lose
+// the journal we keep trying to get it back.
+func startJournal(units string) {
+	j := &journalReader{}
+	for _, unit := range strings.Split(units, ",") {
+		unit = strings.TrimSpace(unit)
+		if unit != "" {
+			j.units = append(j.units, unit)
+		}
+	}
+	_, err := exec.LookPath("journalctl")
+	if err != nil {
+		logFatal(nil, "Failed to find journalctl, %v", err)
+	}
+	go j.follow()
+}
+
+// follow runs journalctl over and over, waiting longer each time it
+// stops straight away.
+func (j *journalReader) follow() {
+	backoff := journalBackoff
+	for {
+		started := time.Now()
+		err := j.read()
+		if time.Since(started) > journalBackoffMax {
+			backoff = journalBackoff
+		}
+		journalRestarts.Inc()
+		logError(nil, "Lost the journal, %v, trying again in %v", err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > journalBackoffMax {
+			backoff = journalBackoffMax
+		}
+	}
+}
+
+// read runs journalctl once, handling the entries it gives us until
+// it stops.
+func (j *journalReader) read() error {
+	//
+	// Like tail, start with new entries, unless we've already seen
+	// some in which case carry on after the last of them.
+	//
+	args := []string{"--follow", "--output=json"}
+	if j.cursor != "" {
+		args = append(args, "--after-cursor="+j.cursor)
+	} else {
+		args = append(args, "--lines=0")
+	}
+	for _, unit := range j.units {
+		args = append(args, "--unit="+unit)
+	}
+
+	cmd := exec.Command("journalctl", args...)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	if *debug {
+		logDebug(nil, "Started journalctl %s, pid %d", strings.Join(args, " "), cmd.Process.Pid)
+	}
+
+	readLinesWith(stdout, os.Stdout, nil, j.entry)
+	err = cmd.Wait()
+	if err == nil {
+		err = io.EOF
+	}
+	return err
+}
+
+// entry handles a journal entry, its message going through the
+// metrics like any other line with the journal fields along with it.
+func (j *journalReader) entry(line string, out io.Writer, fields prometheus.Labels) {
+	var entry map[string]interface{}
+	err := json.Unmarshal([]byte(line), &entry)
+	if err != nil {
+		badJournal.Inc()
+		if *debug {
+			logDebug(logFields{"line": line}, "Malformed journal entry %q", line)
+		}
+		return
+	}
+	if cursor, ok := entry["__CURSOR"].(string); ok {
+		j.cursor = cursor
+	}
+
+	// messages that aren't valid UTF-8 come as arrays of bytes,
+	// which aren't worth trying to match
+	message, ok := entry["MESSAGE"].(string)
+	if !ok {
+		badJournal.Inc()
+		return
+	}
+
+	labels := prometheus.Labels{}
+	for _, name := range journalFields {
+		value, _ := entry[name].(string)
+		labels[name] = value
+	}
+	handleLine(message, out, labels)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jsonLog writes what's logged to stderr as a JSON object a line, for
+// when we're run under a log collector.
+type jsonLog struct {
+	out  io.Writer
+	lock sync.Mutex
+}
+
+// logger is set when logging as JSON.
+var logger *jsonLog
+
+// setLogFormat sends what's logged to stderr as either "text", the
+// standard logger's format, or "json".
+func setLogFormat(format string) {
+	log.SetOutput(os.Stderr)
+	switch format {
+	case "text":
+	case "json":
+		logger = &jsonLog{out: os.Stderr}
+		log.SetFlags(0)
+		log.SetOutput(logger)
+	default:
+		logFatal(nil, "Bad log format %s, only text and json are supported", format)
+	}
+}
+
+// Write is for anything else using the standard logger, which is
+// only net/http's complaints, so they're errors.
+func (j *jsonLog) Write(p []byte) (int, error) {
+	j.event("error", strings.TrimSpace(string(p)), nil)
+	return len(p), nil
+}
+
+// logFields are logged alongside the message when logging as JSON,
+// ie the metric and line being matched.
+type logFields map[string]interface{}
+
+// logAt logs a message at a level, as plain text the fields are left
+// out, the message having said it all.
+func logAt(level string, fields logFields, format string, args ...interface{}) {
+	if logger == nil {
+		log.Printf(format, args...)
+		return
+	}
+	logger.event(level, strings.TrimSpace(fmt.Sprintf(format, args...)), fields)
+}
+
+// logDebug logs the inner workings, callers check -debug first.
+func logDebug(fields logFields, format string, args ...interface{}) {
+	logAt("debug", fields, format, args...)
+}
+
+// logInfo logs what's going on.
+func logInfo(fields logFields, format string, args ...interface{}) {
+	logAt("info", fields, format, args...)
+}
+
+// logWarn logs something that works but needs looking at.
+func logWarn(fields logFields, format string, args ...interface{}) {
+	logAt("warn", fields, format, args...)
+}
+
+// logError logs something failing that we carry on from.
+func logError(fields logFields, format string, args ...interface{}) {
+	logAt("error", fields, format, args...)
+}
+
+// logFatal logs something failing that we can't carry on from, and
+// exits.
+func logFatal(fields logFields, format string, args ...interface{}) {
+	logAt("fatal", fields, format, args...)
+	os.Exit(1)
+}
+
+// event writes a single log entry with any fields alongside the
+// message.
+func (j *jsonLog) event(level string, message string, fields logFields) {
+	entry := map[string]interface{}{}
+	for name, value := range fields {
+		entry[name] = value
+	}
+	entry["time"] = time.Now().Format(time.RFC3339Nano)
+	entry["level"] = level
+	entry["msg"] = message
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	json.NewEncoder(j.out).Encode(entry)
+}
+
+// logMatch logs a metric matching a line when debugging, as JSON
+// with the line and what each group matched.
+func logMatch(metric *Metric, line string, result []string, groupIndex map[string]int) {
+	if logger == nil {
+		log.Printf(" ** Match **\n")
+		return
+	}
+	groups := map[string]string{}
+	for name, index := range groupIndex {
+		if index < len(result) {
+			groups[name] = result[index]
+		}
+	}
+	logDebug(logFields{
+		"metric": metric.Name,
+		"line":   line,
+		"groups": groups,
+	}, "Match")
+}
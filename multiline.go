@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Multiline joins lines into records, for logs where one entry can
+// take up several lines, ie a stack trace.
+type Multiline struct {
+	StartPattern string        `yaml:"startPattern"`
+	MaxLines     int           `yaml:"maxLines"`
+	Timeout      time.Duration `yaml:"timeout"`
+}
+
+// recordJoiner collects lines into a record until the next record
+// starts, too many lines have been collected, or no more lines have
+// come for a while.
+type recordJoiner struct {
+	sync.Mutex
+	start    *regexp.Regexp
+	maxLines int
+	timeout  time.Duration
+	handle   func(record string)
+	lines    []string
+	timer    *time.Timer
+}
+
+func newRecordJoiner(multiline *Multiline, start *regexp.Regexp, handle func(record string)) *recordJoiner {
+	return &recordJoiner{
+		start:    start,
+		maxLines: multiline.MaxLines,
+		timeout:  multiline.Timeout,
+		handle:   handle,
+	}
+}
+
+// add is a lineHandler, so it's called with processing locked.
+func (j *recordJoiner) add(line string, out io.Writer, fields prometheus.Labels) {
+	j.Lock()
+	defer j.Unlock()
+
+	if len(j.lines) > 0 && (j.start.MatchString(line) || len(j.lines) >= j.maxLines) {
+		j.flushLocked()
+	}
+	j.lines = append(j.lines, line)
+
+	// the last record of a burst shouldn't wait for the next burst
+	if j.timer == nil {
+		j.timer = time.AfterFunc(j.timeout, j.expire)
+	} else {
+		j.timer.Reset(j.timeout)
+	}
+}
+
+// expire handles the record if nothing has been added for a while.
+func (j *recordJoiner) expire() {
+	processing.Lock()
+	defer processing.Unlock()
+	j.flush()
+}
+
+// flush handles whatever has been collected, at the end of the input
+// or on a timeout, and must be called with processing locked.
+func (j *recordJoiner) flush() {
+	j.Lock()
+	defer j.Unlock()
+	j.flushLocked()
+}
+
+func (j *recordJoiner) flushLocked() {
+	if len(j.lines) == 0 {
+		return
+	}
+	record := strings.Join(j.lines, "\n")
+	j.lines = j.lines[:0]
+	j.handle(record)
+}
+
+// stop flushes the last record and stops the timer.
+func (j *recordJoiner) stop() {
+	j.flush()
+	j.Lock()
+	if j.timer != nil {
+		j.timer.Stop()
+	}
+	j.Unlock()
+}
+
+// checkMultiline stops us if multiline is set but the lines come from
+// somewhere they aren't joined into records, rather than the metrics
+// quietly never seeing one.
+func checkMultiline() {
+	if cnf.Multiline == nil || flag.NArg() > 0 {
+		return
+	}
+	if *listenIn != "" {
+		logFatal(nil, "multiline can't join lines from -listen-input")
+	}
+	if *syslogIn != "" {
+		logFatal(nil, "multiline can't join syslog messages")
+	}
+	if *journal {
+		logFatal(nil, "multiline can't join journal entries")
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// startListener accepts lines sent over the network, given as a URL
+// like tcp://0.0.0.0:5140 or udp://0.0.0.0:5141. Any number of
+// senders can be connected at once. If remoteLabel is set, a label of
+// that name holds the address a line was sent from. Each line is
+// given to handle. finished is only closed if we stop being able to
+// receive.
+func startListener(address string, remoteLabel string, handle lineHandler, finished chan struct{}) {
+	where, err := url.Parse(address)
+	if err != nil {
+		logFatal(nil, "Bad input address %s, %v", address, err)
+	}
+
+	switch where.Scheme {
+	case "tcp":
+		listener, err := net.Listen("tcp", where.Host)
+		if err != nil {
+			logFatal(nil, "Failed to listen for input on %s, %v", where.Host, err)
+		}
+		go acceptLines(listener, remoteLabel, handle, finished)
+	case "udp":
+		conn, err := net.ListenPacket("udp", where.Host)
+		if err != nil {
+			logFatal(nil, "Failed to listen for input on %s, %v", where.Host, err)
+		}
+		go readDatagrams(conn, remoteLabel, handle, finished)
+	default:
+		logFatal(nil, "Bad input address %s, only tcp:// and udp:// are supported", address)
+	}
+}
+
+// acceptLines reads lines from each connection made to the listener.
+// A connection that goes wrong only loses that connection.
+func acceptLines(listener net.Listener, remoteLabel string, handle lineHandler, finished chan struct{}) {
+	defer close(finished)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			logError(nil, "Failed to accept input connection, %v", err)
+			return
+		}
+
+		var fields prometheus.Labels
+		if remoteLabel != "" {
+			fields = prometheus.Labels{remoteLabel: remoteHost(conn.RemoteAddr())}
+		}
+		if *debug {
+			logDebug(nil, "Input connection from %s", conn.RemoteAddr())
+		}
+
+		inputConnections.Inc()
+		go func() {
+			defer inputConnections.Dec()
+			defer conn.Close()
+			readLinesWith(conn, os.Stdout, fields, handle)
+		}()
+	}
+}
+
+// datagram is some lines that arrived in one go.
+type datagram struct {
+	lines  []string
+	fields prometheus.Labels
+}
+
+// readDatagrams reads lines that arrive as datagrams, each of which
+// can have any number of lines. They're handed over to be processed
+// through a queue so that a burst doesn't stop us reading, when the
+// queue is full they're dropped.
+func readDatagrams(conn net.PacketConn, remoteLabel string, handle lineHandler, finished chan struct{}) {
+	queue := make(chan datagram, 1000)
+	go func() {
+		atomic.AddInt32(&readersActive, 1)
+		defer atomic.AddInt32(&readersActive, -1)
+		for {
+			atomic.AddInt32(&readersWaiting, 1)
+			received, ok := <-queue
+			atomic.AddInt32(&readersWaiting, -1)
+			if !ok {
+				close(finished)
+				return
+			}
+			for _, line := range received.lines {
+				processing.Lock()
+				handle(line, os.Stdout, received.fields)
+				processing.Unlock()
+			}
+		}
+	}()
+
+	// anything bigger is cut short
+	buffer := make([]byte, *maxPacket)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			logError(nil, "Failed to read input datagram, %v", err)
+			close(queue)
+			return
+		}
+
+		var lines []string
+		for _, line := range strings.Split(string(buffer[:n]), "\n") {
+			line = strings.TrimSuffix(line, "\r")
+			if line != "" {
+				lines = append(lines, line)
+			}
+		}
+		received := datagram{lines: lines}
+		if remoteLabel != "" {
+			received.fields = prometheus.Labels{remoteLabel: remoteHost(addr)}
+		}
+
+		select {
+		case queue <- received:
+		default:
+			droppedLines.Add(float64(len(lines)))
+		}
+	}
+}
+
+// remoteHost is the host part of an address, the port being
+// different for every connection.
+func remoteHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
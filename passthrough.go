@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// passthrough is where lines are passed through to if we've been told,
+// otherwise they go back out the way they came, ie a command's stderr
+// to our stderr.
+var passthrough io.Writer
+
+// setPassthrough sends the lines passed through to stdout, stderr or
+// a file, which is appended to. "" leaves them where they were.
+func setPassthrough(to string) {
+	switch to {
+	case "":
+	case "stdout":
+		passthrough = os.Stdout
+	case "stderr":
+		passthrough = os.Stderr
+	default:
+		f, err := os.OpenFile(to, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			logFatal(nil, "Failed to open passthrough %s, %v", to, err)
+		}
+		passthrough = f
+	}
+}
+
+// passLine replicates the line to out, or the passthrough, as it was
+// read. A multiline record goes out as the lines it was joined from,
+// each ending with the -delimiter they came with.
+func passLine(out io.Writer, line string) {
+	if passthrough != nil {
+		out = passthrough
+	}
+	if cnf.Multiline != nil && recordEnd != nil {
+		line = strings.Replace(line, "\n", string(recordEnd), -1)
+	}
+	fmt.Fprintf(out, "%s%s", line, lineEnd())
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// filePosition is how far we got through a file, the inode telling
+// us whether it's still the same file next time.
+type filePosition struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+var (
+	// guards both of the below
+	positionLock sync.Mutex
+
+	// positions from the file when we started, for resuming
+	savedPositions = map[string]filePosition{}
+
+	// files being followed now, whose positions will be saved
+	followed = map[string]*followReader{}
+)
+
+// loadPositions reads the position file, it not being there yet is
+// fine.
+func loadPositions(path string) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		logFatal(nil, "Failed to read position file %s, %v", path, err)
+	}
+
+	positionLock.Lock()
+	defer positionLock.Unlock()
+	err = json.Unmarshal(data, &savedPositions)
+	if err != nil {
+		logFatal(nil, "Failed to parse position file %s, %v", path, err)
+	}
+}
+
+// resumePosition says where to carry on reading a file from, if we
+// were part way through it last time.
+func resumePosition(name string, f *os.File) (int64, bool) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, false
+	}
+
+	positionLock.Lock()
+	saved, ok := savedPositions[name]
+	positionLock.Unlock()
+	if !ok || saved.Inode != inode(info) || saved.Offset > info.Size() {
+		return 0, false
+	}
+	return saved.Offset, true
+}
+
+// savePositions writes out where we are in every file being followed.
+// Saved positions for files we aren't following are kept as long as
+// the same file is still there, so a glob that matches it again
+// later picks up where it left off.
+func savePositions(path string) {
+	positionLock.Lock()
+	positions := map[string]filePosition{}
+	for name, saved := range savedPositions {
+		info, err := os.Stat(name)
+		if err == nil && inode(info) == saved.Inode {
+			positions[name] = saved
+		}
+	}
+	for name, f := range followed {
+		positions[name] = f.position()
+	}
+	savedPositions = positions
+	positionLock.Unlock()
+
+	data, err := json.MarshalIndent(positions, "", "  ")
+	if err != nil {
+		logError(nil, "Failed to save positions, %v", err)
+		return
+	}
+
+	//
+	// Write somewhere else and move it into place, so being killed
+	// part way through doesn't leave half a file behind.
+	//
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		logError(nil, "Failed to save positions, %v", err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		logError(nil, "Failed to save positions, %v", err)
+	}
+}
+
+// keepPositions saves the positions every so often.
+func keepPositions(path string) {
+	for range time.Tick(5 * time.Second) {
+		savePositions(path)
+	}
+}
+
+// inode gets the inode number of a file.
+func inode(info os.FileInfo) uint64 {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+	return uint64(stat.Ino)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"time"
+)
+
+// pushMetrics sends everything we have to the pushgateway, replacing
+// whatever was there for our job and grouping.
+func pushMetrics(url string) error {
+	cnfLock.RLock()
+	job := cnf.Job
+	grouping := cnf.Grouping
+	cnfLock.RUnlock()
+
+	pusher := push.New(url, job).Gatherer(untimestamped{gatherer})
+	for name, value := range grouping {
+		pusher = pusher.Grouping(name, value)
+	}
+	err := pusher.Push()
+	if err != nil {
+		logError(nil, "Failed to push to %s, %v", url, err)
+		return err
+	}
+	if *debug {
+		logDebug(nil, "Pushed to %s as job %s", url, job)
+	}
+	return nil
+}
+
+// keepPushing pushes to the pushgateway every so often.
+func keepPushing(url string, every time.Duration) {
+	for range time.Tick(every) {
+		pushMetrics(url)
+	}
+}
+
+// finalPush pushes the final values, trying again up to retries
+// times a second apart if it doesn't work. It says whether they got
+// there.
+func finalPush(url string, retries int) bool {
+	for try := 0; ; try++ {
+		if pushMetrics(url) == nil {
+			return true
+		}
+		if try >= retries {
+			return false
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// untimestamped gathers without the timestamps, which the pushgateway
+// refuses, so a gauge given the time of its line is pushed as of now
+// rather than stopping everything being pushed.
+type untimestamped struct {
+	prometheus.Gatherer
+}
+
+func (u untimestamped) Gather() ([]*dto.MetricFamily, error) {
+	families, err := u.Gatherer.Gather()
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			metric.TimestampMs = nil
+		}
+	}
+	return families, err
+}
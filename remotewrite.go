@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// RemoteWrite is where to send samples with prometheus's remote write
+// protocol, for when nothing can scrape us.
+type RemoteWrite struct {
+	URL         string        `yaml:"url"`
+	Username    string        `yaml:"username"`
+	Password    string        `yaml:"password"`
+	BearerToken string        `yaml:"bearerToken"`
+	Interval    time.Duration `yaml:"interval"`
+	MaxSamples  int           `yaml:"maxSamples"`
+}
+
+// how long to wait before trying again after a failed write, at first
+const remoteBackoff = time.Second
+
+// remoteSample is a single sample of a series, with all its labels
+// including the name, sorted.
+type remoteSample struct {
+	labels    []remoteLabel
+	value     float64
+	timestamp int64
+}
+
+type remoteLabel struct {
+	name, value string
+}
+
+// keepRemoteWriting gathers our metrics every interval and sends them
+// on. Samples that can't be sent are kept to try again, backing off,
+// up to maxSamples of them after which the oldest are dropped.
+func keepRemoteWriting(rw RemoteWrite) {
+	var queue []remoteSample
+	backoff := remoteBackoff
+	tick := time.NewTicker(rw.Interval)
+	retry := time.NewTimer(rw.Interval)
+	retry.Stop()
+
+	for {
+		select {
+		case now := <-tick.C:
+			samples, err := gatherSamples(gatherer, now)
+			if err != nil {
+				logError(nil, "Failed to gather metrics for remote write, %v", err)
+			}
+			queue = append(queue, samples...)
+		case <-retry.C:
+		}
+
+		if len(queue) > rw.MaxSamples {
+			remoteDropped.Add(float64(len(queue) - rw.MaxSamples))
+			queue = queue[len(queue)-rw.MaxSamples:]
+		}
+		remoteQueued.Set(float64(len(queue)))
+		if len(queue) == 0 {
+			continue
+		}
+
+		unsent, dropped, err := rw.sendSplitting(queue)
+		remoteDropped.Add(float64(dropped))
+		queue = unsent
+		remoteQueued.Set(float64(len(queue)))
+		if err == nil {
+			backoff = remoteBackoff
+			retry.Stop()
+			continue
+		}
+		remoteFailures.Inc()
+		logError(nil, "Failed to remote write to %s, %v", rw.URL, err)
+
+		// anything left wasn't there or was too busy, not rejected
+		if len(queue) == 0 {
+			continue
+		}
+		retry.Reset(backoff)
+		backoff *= 2
+		if backoff > rw.Interval {
+			backoff = rw.Interval
+		}
+	}
+}
+
+// sendSplitting sends the samples. If the remote end rejects them,
+// ie for a timestamp older than one it already has, it tries again
+// with each half of them, so only the samples it doesn't like are
+// dropped. It returns those that still need sending after an error
+// that's worth trying again, and how many were dropped.
+func (rw RemoteWrite) sendSplitting(samples []remoteSample) ([]remoteSample, int, error) {
+	err := rw.send(samples)
+	if err == nil {
+		return nil, 0, nil
+	}
+	if _, ok := err.(remoteRejected); !ok {
+		return samples, 0, err
+	}
+	if len(samples) == 1 {
+		return nil, 1, err
+	}
+
+	half := len(samples) / 2
+	unsent, dropped, err := rw.sendSplitting(samples[:half])
+	if len(unsent) > 0 {
+		return append(append([]remoteSample(nil), unsent...), samples[half:]...), dropped, err
+	}
+	unsent, more, laterErr := rw.sendSplitting(samples[half:])
+	if laterErr != nil {
+		err = laterErr
+	}
+	return unsent, dropped + more, err
+}
+
+// remoteRejected is the remote end saying no to what we sent.
+type remoteRejected string
+
+func (e remoteRejected) Error() string {
+	return string(e)
+}
+
+// send posts the samples to the remote end as a snappy compressed
+// WriteRequest.
+func (rw RemoteWrite) send(samples []remoteSample) error {
+	body := snappyBlock(encodeWriteRequest(samples))
+	req, err := http.NewRequest("POST", rw.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if rw.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+rw.BearerToken)
+	} else if rw.Username != "" {
+		req.SetBasicAuth(rw.Username, rw.Password)
+	}
+
+	client := http.Client{Timeout: rw.Interval}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("%s, %s", resp.Status, bytes.TrimSpace(message))
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		return remoteRejected(err.Error())
+	}
+	return err
+}
+
+// gatherSamples turns everything registered into samples at the given
+// time, histograms and summaries into their buckets or quantiles and
+// their sum and count.
+func gatherSamples(gatherer prometheus.Gatherer, now time.Time) ([]remoteSample, error) {
+	families, err := gatherer.Gather()
+	var samples []remoteSample
+	for _, family := range families {
+		name := family.GetName()
+		for _, metric := range family.GetMetric() {
+			at := now.UnixNano() / int64(time.Millisecond)
+			if metric.GetTimestampMs() != 0 {
+				at = metric.GetTimestampMs()
+			}
+			add := func(suffix string, value float64, extra ...string) {
+				labels := []remoteLabel{{"__name__", name + suffix}}
+				for _, pair := range metric.GetLabel() {
+					labels = append(labels, remoteLabel{pair.GetName(), pair.GetValue()})
+				}
+				for i := 0; i+1 < len(extra); i += 2 {
+					labels = append(labels, remoteLabel{extra[i], extra[i+1]})
+				}
+				sort.Slice(labels, func(i, j int) bool {
+					return labels[i].name < labels[j].name
+				})
+				samples = append(samples, remoteSample{labels, value, at})
+			}
+
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", metric.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add("", metric.GetGauge().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				histogram := metric.GetHistogram()
+				for _, bucket := range histogram.GetBucket() {
+					add("_bucket", float64(bucket.GetCumulativeCount()),
+						"le", formatFloat(bucket.GetUpperBound()))
+				}
+				add("_bucket", float64(histogram.GetSampleCount()), "le", "+Inf")
+				add("_sum", histogram.GetSampleSum())
+				add("_count", float64(histogram.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				summary := metric.GetSummary()
+				for _, quantile := range summary.GetQuantile() {
+					add("", quantile.GetValue(),
+						"quantile", formatFloat(quantile.GetQuantile()))
+				}
+				add("_sum", summary.GetSampleSum())
+				add("_count", float64(summary.GetSampleCount()))
+			default:
+				add("", metric.GetUntyped().GetValue())
+			}
+		}
+	}
+	return samples, err
+}
+
+// formatFloat writes a bucket bound or quantile the way prometheus
+// does.
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+//
+// A WriteRequest is, in protobuf,
+//
+//   WriteRequest { repeated TimeSeries timeseries = 1; }
+//   TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//   Label        { string name = 1; string value = 2; }
+//   Sample       { double value = 1; int64 timestamp = 2; }
+//
+// which is simple enough to write out by hand.
+//
+
+// encodeWriteRequest makes a WriteRequest with a series for each
+// sample.
+func encodeWriteRequest(samples []remoteSample) []byte {
+	var request []byte
+	for _, sample := range samples {
+		var series []byte
+		for _, label := range sample.labels {
+			var pair []byte
+			pair = protoBytes(pair, 1, []byte(label.name))
+			pair = protoBytes(pair, 2, []byte(label.value))
+			series = protoBytes(series, 1, pair)
+		}
+
+		var value []byte
+		value = protoVarint(value, 1<<3|1)
+		bits := make([]byte, 8)
+		binary.LittleEndian.PutUint64(bits, math.Float64bits(sample.value))
+		value = append(value, bits...)
+		value = protoVarint(value, 2<<3|0)
+		value = protoVarint(value, uint64(sample.timestamp))
+		series = protoBytes(series, 2, value)
+
+		request = protoBytes(request, 1, series)
+	}
+	return request
+}
+
+// protoBytes appends a length delimited field.
+func protoBytes(buf []byte, field uint64, data []byte) []byte {
+	buf = protoVarint(buf, field<<3|2)
+	buf = protoVarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+// protoVarint appends a varint.
+func protoVarint(buf []byte, v uint64) []byte {
+	varint := make([]byte, binary.MaxVarintLen64)
+	return append(buf, varint[:binary.PutUvarint(varint, v)]...)
+}
+
+// snappyBlock wraps data up as a snappy block without compressing it,
+// as a run of literals, which any snappy decoder will take. Samples
+// are small enough not to be worth the trouble.
+func snappyBlock(data []byte) []byte {
+	block := protoVarint(nil, uint64(len(data)))
+	for len(data) > 0 {
+		n := len(data)
+		if n > 65536 {
+			n = 65536
+		}
+		// a literal with its length less one in the next two bytes
+		block = append(block, 61<<2, byte(n-1), byte((n-1)>>8))
+		block = append(block, data[:n]...)
+		data = data[n:]
+	}
+	return block
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"regexp"
+	"strings"
+)
+
+// labelRewrites is the rewrites for each of a metric's labels, by
+// the label's name.
+type labelRewrites map[string][]labelRewrite
+
+// labelRewrite is a step in tidying up a label's value, either a
+// regex replacement, ie turning "web1:8080" into "web1", or
+// lowercasing it.
+type labelRewrite struct {
+	Match       string `yaml:"match"`
+	Replacement string `yaml:"replacement"`
+	Lowercase   bool   `yaml:"lowercase"`
+
+	compiled *regexp.Regexp
+}
+
+// compileRewrites readies the metric's rewrites, returning what's
+// wrong with them.
+func (m *Metric) compileRewrites() []string {
+	// a JSON or logfmt metric's labels are named after their paths,
+	// rewrites can be for either
+	if m.JSON || m.Logfmt {
+		renamed := labelRewrites{}
+		for path, rewrites := range m.Rewrite {
+			renamed[labelName(path)] = append(renamed[labelName(path)], rewrites...)
+		}
+		m.Rewrite = renamed
+	}
+
+	var problems []string
+	for name, rewrites := range m.Rewrite {
+		if indexOf(name, m.Labels) == -1 {
+			problems = append(problems, fmt.Sprintf("metric %s has a rewrite for %s, which isn't one of its labels",
+				m.Name, name))
+		}
+		for index, rewrite := range rewrites {
+			if rewrite.Match == "" {
+				if !rewrite.Lowercase {
+					problems = append(problems, fmt.Sprintf("metric %s rewrite %d of %s needs a match or lowercase",
+						m.Name, index+1, name))
+				}
+				continue
+			}
+			compiled, err := regexp.Compile("^(?:" + rewrite.Match + ")$")
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("metric %s rewrite %d of %s has a bad match, %v",
+					m.Name, index+1, name, err))
+				continue
+			}
+			rewrites[index].compiled = compiled
+		}
+	}
+	return problems
+}
+
+// rewriteLabel runs the value through each of the rewrites in turn.
+// A match has to be the whole value, if it isn't the value is left
+// as it is.
+func rewriteLabel(value string, rewrites []labelRewrite) string {
+	for _, rewrite := range rewrites {
+		if rewrite.compiled != nil {
+			value = rewrite.compiled.ReplaceAllString(value, rewrite.Replacement)
+		}
+		if rewrite.Lowercase {
+			value = strings.ToLower(value)
+		}
+	}
+	return value
+}
+
+// labelAllowlist limits the values labels can have, so free-form text
+// in a log can't make an unbounded number of series. Any other value
+// becomes other, or if drop is set the match is dropped.
+type labelAllowlist struct {
+	values map[string]map[string]bool
+	other  string
+	drop   bool
+}
+
+var errDisallowed = errors.New("label value isn't allowed")
+
+// compileAllowlist readies the metric's allowed values, returning
+// what's wrong with them.
+func (m *Metric) compileAllowlist() []string {
+	m.Allowed = nil
+	if len(m.AllowValues) == 0 {
+		if m.OtherValue != nil || m.DropOthers {
+			return []string{fmt.Sprintf("metric %s has otherValue or dropOthers but no allowedValues", m.Name)}
+		}
+		return nil
+	}
+
+	var problems []string
+	allowed := &labelAllowlist{
+		values: map[string]map[string]bool{},
+		other:  "other",
+		drop:   m.DropOthers,
+	}
+	if m.OtherValue != nil {
+		allowed.other = *m.OtherValue
+	}
+	for name, values := range m.AllowValues {
+		// and the same for allowed values
+		if m.JSON || m.Logfmt {
+			name = labelName(name)
+		}
+		if indexOf(name, m.Labels) == -1 {
+			problems = append(problems, fmt.Sprintf("metric %s has allowedValues for %s, which isn't one of its labels",
+				m.Name, name))
+		}
+		if allowed.values[name] == nil {
+			allowed.values[name] = map[string]bool{}
+		}
+		for _, value := range values {
+			allowed.values[name][value] = true
+		}
+	}
+	m.Allowed = allowed
+	return problems
+}
+
+// check replaces any values that aren't allowed with the other value,
+// or says the labels should be dropped.
+func (a *labelAllowlist) check(labels prometheus.Labels) error {
+	if a == nil {
+		return nil
+	}
+	for name, values := range a.values {
+		value, ok := labels[name]
+		if !ok || values[value] {
+			continue
+		}
+		if a.drop {
+			return errDisallowed
+		}
+		disallowedValues.Inc()
+		labels[name] = a.other
+	}
+	return nil
+}
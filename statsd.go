@@ -0,0 +1,116 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// StatsD is a statsd server that counter and gauge updates are sent on
+// to as well, for those that haven't moved to prometheus yet.
+type StatsD struct {
+	Address string `yaml:"address"`
+	Prefix  string `yaml:"prefix"`
+	Tags    bool   `yaml:"tags"`
+}
+
+// how many updates can be waiting to be sent before we drop them
+const statsdQueue = 1000
+
+// statsdSink sends updates over UDP from its own goroutine, so an
+// unreachable statsd doesn't hold up matching.
+type statsdSink struct {
+	prefix  string
+	tags    bool
+	updates chan string
+}
+
+// statsd is where updates are sent, if anywhere.
+var statsd *statsdSink
+
+// startStatsd starts sending counter and gauge updates to the statsd
+// server.
+func startStatsd(c StatsD) {
+	where, err := url.Parse(c.Address)
+	if err != nil || where.Scheme != "udp" {
+		logFatal(nil, "Bad statsd address %s, only udp:// is supported", c.Address)
+	}
+	conn, err := net.Dial("udp", where.Host)
+	if err != nil {
+		logFatal(nil, "Failed to reach statsd on %s, %v", where.Host, err)
+	}
+
+	statsd = &statsdSink{
+		prefix:  c.Prefix,
+		tags:    c.Tags,
+		updates: make(chan string, statsdQueue),
+	}
+	go func() {
+		for update := range statsd.updates {
+			_, err := conn.Write([]byte(update))
+			if err != nil {
+				statsdErrors.Inc()
+				if *debug {
+					logDebug(nil, "Failed to send to statsd, %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// sendStatsd passes a counter or gauge update on to statsd, if we're
+// sending them there. add is whether a gauge was moved rather than
+// set.
+func sendStatsd(metric *Metric, labels prometheus.Labels, value float64, add bool) {
+	if statsd == nil {
+		return
+	}
+
+	name := statsd.prefix + metric.FullName
+	var update string
+	switch {
+	case metric.Type == "counter":
+		update = name + ":" + formatStatsd(value) + "|c" + statsd.tagged(labels)
+	case add:
+		// a sign makes it a change rather than the value
+		sign := "+"
+		if value < 0 {
+			sign = ""
+		}
+		update = name + ":" + sign + formatStatsd(value) + "|g" + statsd.tagged(labels)
+	case value < 0:
+		// a negative value would be taken as a change, so zero it first
+		update = name + ":0|g" + statsd.tagged(labels) + "\n" +
+			name + ":" + formatStatsd(value) + "|g" + statsd.tagged(labels)
+	default:
+		update = name + ":" + formatStatsd(value) + "|g" + statsd.tagged(labels)
+	}
+
+	select {
+	case statsd.updates <- update:
+	default:
+		statsdErrors.Inc()
+	}
+}
+
+// tagged is the labels as datadog style tags, if we're sending them.
+func (s *statsdSink) tagged(labels prometheus.Labels) string {
+	if !s.tags || len(labels) == 0 {
+		return ""
+	}
+	tags := make([]string, 0, len(labels))
+	for name, value := range labels {
+		tags = append(tags, name+":"+value)
+	}
+	sort.Strings(tags)
+	return "|#" + strings.Join(tags, ",")
+}
+
+// formatStatsd writes a value without an exponent, which statsd
+// doesn't understand.
+func formatStatsd(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
@@ -2,19 +2,31 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/yaml.v2"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"reflect"
 	"regexp"
+	"runtime"
 	"runtime/pprof"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -24,40 +36,176 @@ import (
 // and regexes are created for each metric.
 //
 type Data struct {
-	Basename   string `yaml:"basename,omitempty"`
-	EatMatches bool   `yaml:"eatMatches"`
-	EatAll     bool   `yaml:"eatAll"`
-	Listen     string `yaml:"listen"`
-	Path       string `yaml:"path"`
-	Metrics    []struct {
-		Name        string   `yaml:"name,omitempty"`
-		Description string   `yaml:"description,omitempty"`
-		Regex       string   `yaml:"regex,omitempty"`
-		Value       string   `yaml:"value,omitempty"`
-		Labels      []string `yaml:"labels,omitempty"`
-		Collector   prometheus.Collector
-		Compiled    *regexp.Regexp
-		GroupName   []string
-	} `yaml:"metrics,omitempty"`
+	Basename        string            `yaml:"basename,omitempty"`
+	EatMatches      bool              `yaml:"eatMatches"`
+	EatAll          bool              `yaml:"eatAll"`
+	EatUnmatched    bool              `yaml:"eatUnmatched"`
+	Ignore          regexList         `yaml:"ignore"`
+	PassIgnored     bool              `yaml:"passIgnored"`
+	StopOnFirst     bool              `yaml:"stopOnFirstMatch"`
+	MaxLineLength   int               `yaml:"maxLineLength"`
+	StreamLabel     string            `yaml:"streamLabel"`
+	FileLabel       string            `yaml:"fileLabel"`
+	RemoteLabel     string            `yaml:"remoteLabel"`
+	ContainerLabel  string            `yaml:"containerLabel"`
+	ConstLabels     prometheus.Labels `yaml:"constLabels"`
+	Job             string            `yaml:"job"`
+	Grouping        map[string]string `yaml:"grouping"`
+	RemoteWrite     *RemoteWrite      `yaml:"remoteWrite"`
+	StatsD          *StatsD           `yaml:"statsd"`
+	Multiline       *Multiline        `yaml:"multiline"`
+	PatternsFile    string            `yaml:"patternsFile"`
+	Listen          string            `yaml:"listen"`
+	ListenMode      string            `yaml:"listenMode"`
+	Path            string            `yaml:"path"`
+	HealthPath      string            `yaml:"healthPath"`
+	ReadyPath       string            `yaml:"readyPath"`
+	ReadyWithin     time.Duration     `yaml:"readyWithin"`
+	OpenMetrics     bool              `yaml:"openMetrics"`
+	GoMetrics       bool              `yaml:"goMetrics"`
+	ProcessMetrics  bool              `yaml:"processMetrics"`
+	BasicAuthUsers  map[string]string `yaml:"basicAuthUsers"`
+	TLSCertFile     string            `yaml:"tlsCertFile"`
+	TLSKeyFile      string            `yaml:"tlsKeyFile"`
+	TLSClientCAFile string            `yaml:"tlsClientCAFile"`
+	IngestPath      string            `yaml:"ingestPath"`
+	IngestMaxBytes  int64             `yaml:"ingestMaxBytes"`
+	Metrics         []Metric          `yaml:"metrics,omitempty"`
+
+	ignored     []*regexp.Regexp
+	stopping    bool
+	multiline   *regexp.Regexp
+	patterns    patternLibrary
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+}
+
+// Metric is a single metric from the config file along with the
+// collector and regexes made for it.
+type Metric struct {
+	Name        string              `yaml:"name,omitempty"`
+	Description string              `yaml:"description,omitempty"`
+	Type        string              `yaml:"type,omitempty"`
+	Regex       regexList           `yaml:"regex,omitempty"`
+	Value       string              `yaml:"value,omitempty"`
+	Labels      labelList           `yaml:"labels,omitempty"`
+	ConstLabels prometheus.Labels   `yaml:"constLabels,omitempty"`
+	Mode        string              `yaml:"mode,omitempty"`
+	EatMatches  *bool               `yaml:"eatMatches,omitempty"`
+	Continue    *bool               `yaml:"continue,omitempty"`
+	NegateOn    string              `yaml:"negateOn,omitempty"`
+	Exclude     string              `yaml:"exclude,omitempty"`
+	EatExcluded bool                `yaml:"eatExcluded,omitempty"`
+	Scale       *float64            `yaml:"scale,omitempty"`
+	Offset      float64             `yaml:"offset,omitempty"`
+	Min         *float64            `yaml:"min,omitempty"`
+	Max         *float64            `yaml:"max,omitempty"`
+	Buckets     []float64           `yaml:"buckets,omitempty"`
+	Objectives  map[float64]float64 `yaml:"objectives,omitempty"`
+	MaxAge      time.Duration       `yaml:"maxAge,omitempty"`
+	TTL         time.Duration       `yaml:"ttl,omitempty"`
+	Format      string              `yaml:"format,omitempty"`
+	JSON        bool                `yaml:"json,omitempty"`
+	Logfmt      bool                `yaml:"logfmt,omitempty"`
+	Match       map[string]string   `yaml:"match,omitempty"`
+	Rewrite     labelRewrites       `yaml:"rewrite,omitempty"`
+	AllowValues map[string][]string `yaml:"allowedValues,omitempty"`
+	OtherValue  *string             `yaml:"otherValue,omitempty"`
+	DropOthers  bool                `yaml:"dropOthers,omitempty"`
+	Timestamp   string              `yaml:"timestamp,omitempty"`
+	TimeLayout  string              `yaml:"timeLayout,omitempty"`
+	MustContain string              `yaml:"mustContain,omitempty"`
+	Multiline   bool                `yaml:"multiline,omitempty"`
+	Tests       []MetricTest        `yaml:"tests,omitempty"`
+	FullName    string
+	Collector   prometheus.Collector
+	Compiled    []*regexp.Regexp
+	GroupIndex  []map[string]int
+	Eat         bool
+	Stop        bool
+	Literals    []string
+	FieldIndex  map[string]int
+	FieldPaths  []string
+	Matchers    []fieldMatcher
+	Allowed     *labelAllowlist
+	Negate      *regexp.Regexp
+	Excluded    *regexp.Regexp
+	Series      *seriesTracker
 }
 
 var (
 	// some defaults
-	cnf = Data{
+	defaults = Data{
+		Job:        "stdout2prom",
 		Listen:     ":9000",
 		Path:       "/metrics",
+		HealthPath: "/healthz",
+		ReadyPath:  "/ready",
 		EatMatches: false,
 		EatAll:     false,
+
+		MaxLineLength:  1024 * 1024,
+		IngestMaxBytes: 1024 * 1024,
+		ReadyWithin:    time.Minute,
+		GoMetrics:      true,
+		ProcessMetrics: true,
 	}
 
+	// the running config, guarded by cnfLock as it's swapped on reload
+	cnf     Data
+	cnfLock sync.RWMutex
+
+	// held while a line is processed, shutting down takes it for good
+	processing sync.Mutex
+
+	// 1 until we've finished with the input and are on our way out
+	healthy int32 = 1
+
+	// when the last line was read, in unix nanoseconds
+	lastLine int64
+
+	// when the last completed scrape started, in unix nanoseconds
+	lastScrape int64
+
 	// parameters
 	debug      = flag.Bool("debug", false, "Display more of the inner workings.")
+	quiet      = flag.Bool("quiet", false, "Don't pass any lines through, whatever eatAll and eatMatches say.")
+	passTo     = flag.String("passthrough", "", "Where lines are passed through to, stdout, stderr or a file, rather than where they came from.")
+	logFormat  = flag.String("log-format", "text", "How to log to stderr, text or json.")
 	config     = flag.String("config", "metrics.yml", "Config file.")
+	expand     = flag.Bool("expand-env", false, "Replace ${VAR} and ${VAR:-default} in the config file with environment variables.")
+	pushURL    = flag.String("pushgateway", "", "URL of a pushgateway to push metrics to, as well as serving them.")
+	pushTries  = flag.Int("push-retries", 3, "How many more times to try the final push to the pushgateway if it fails.")
+	pushEvery  = flag.Duration("push-interval", 15*time.Second, "How often to push to the pushgateway.")
+	workers    = flag.Int("workers", runtime.GOMAXPROCS(0), "How many goroutines share out the metrics each line is matched against.")
+	profileRe  = flag.Bool("profile-regex", false, "Time each regex, in stdout2prom_regex_duration_seconds.")
 	cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
+	input      = flag.String("input", "-", "File to read lines from, - for stdin.")
+	listenIn   = flag.String("listen-input", "", "Accept lines over the network rather than reading them, ie tcp://0.0.0.0:5140 or udp://0.0.0.0:5141.")
+	maxPacket  = flag.Int("max-datagram", 65535, "Longest datagram in bytes that can be received, any more is cut off.")
+	syslogIn   = flag.String("syslog", "", "Accept syslog messages rather than reading lines, ie udp://0.0.0.0:514 or tcp://0.0.0.0:514.")
+	journal    = flag.Bool("journal", false, "Follow the systemd journal rather than reading lines.")
+	units      = flag.String("journal-unit", "", "When following the journal, only follow these units, ie myapp.service,other.service.")
+	container  = flag.String("docker-container", "", "Read the logs of this docker container, by name or ID, rather than reading lines.")
+	dockerSock = flag.String("docker-socket", "/var/run/docker.sock", "Where to find the docker engine's API.")
+	fifo       = flag.String("fifo", "", "Named pipe to read lines from, reopened whenever the writer closes it.")
+	follow     = flag.Bool("follow", false, "Keep reading the input file as it grows, like tail -F.")
+	rescan     = flag.Duration("glob-interval", 10*time.Second, "When following a glob, how often to look for new files.")
+	fromStart  = flag.Bool("from-start", false, "When following, read the input file from the start rather than the end.")
+	posFile    = flag.String("position-file", "", "When following, save how far through each file we are here and carry on from there on restart.")
+	maxLine    = flag.Int("max-line", 0, "Longest line in bytes that can be read, overrides maxLineLength.")
+	drain      = flag.Duration("drain", 0, "After SIGTERM or SIGINT wait up to this long for a final scrape.")
 	tardy      = flag.Int("tardy", 0, "Hang around for X seconds after stdin closes")
-
-	labels prometheus.Labels
-	value  float64
+	waitScrape = flag.Duration("wait-for-scrape", 0, "After stdin closes exit after the next scrape, waiting up to this long.")
+	check      = flag.Bool("check-config", false, "Check the config file and exit.")
+	testCnf    = flag.Bool("test", false, "Run the tests in the config file and exit.")
+	sample     = flag.Int("sample", 0, "Only match every Nth line against the metrics, for when there are too many lines to keep up with.")
+	dryRun     = flag.Bool("dry-run", false, "Print what matched to stderr rather than serving metrics.")
+	dryRunFmt  = flag.String("dry-run-format", "text", "How -dry-run prints each match, text or json.")
+	lifecycle  = flag.Bool("web.enable-lifecycle", false, "Enable config reloads via HTTP POST to /-/reload.")
+	printVer   = flag.Bool("version", false, "Print the version and exit.")
+	delimiter  = flag.String("delimiter", `\n`, `What the input's lines end with, ie \0 for NUL or \x1e.`)
+	unmatchedN = flag.Int("debug-unmatched", 0, "Keep the last N lines that didn't match anything to show at /debug/unmatched.")
 
 	// some metrics for ourself
 	totalLines = prometheus.NewCounter(
@@ -74,6 +222,40 @@ var (
 		},
 	)
 
+	metricMatches = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "stdout2prom_metric_matches_total",
+			Help: "Total lines each metric has matched",
+		},
+		[]string{"metric"},
+	)
+
+	metricErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "stdout2prom_metric_errors_total",
+			Help: "Total matches each metric couldn't use, by why not",
+		},
+		[]string{"metric", "reason"},
+	)
+
+	metricSeries = newSeriesCounter()
+
+	regexDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "stdout2prom_regex_duration_seconds",
+			Help:    "How long each metric's regexes take to run against a line, with -profile-regex",
+			Buckets: prometheus.ExponentialBuckets(1e-6, 4, 10),
+		},
+		[]string{"metric"},
+	)
+
+	compressedBytes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "stdout2prom_compressed_bytes_read_total",
+			Help: "Total number of gzipped bytes read, before they were gunzipped",
+		},
+	)
+
 	matchedLines = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Name: "stdout2prom_matched_lines_total",
@@ -81,242 +263,1990 @@ var (
 		},
 	)
 
+	skippedLines = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "stdout2prom_sampled_out_lines_total",
+			Help: "Total lines not matched against the metrics because of -sample",
+		},
+	)
+
+	notJSON = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "stdout2prom_non_json_lines_total",
+			Help: "Total lines a json metric looked at that weren't JSON objects",
+		},
+	)
+
+	unmatchedLines = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "stdout2prom_unmatched_lines_total",
+			Help: "Total lines that didn't match any of the regexes",
+		},
+	)
+
 	badFloats = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Name: "stdout2prom_bad_floats_total",
 			Help: "Total lines that failed to convert correctly",
 		},
 	)
+
+	outOfRange = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "stdout2prom_out_of_range_values_total",
+			Help: "Total values thrown away for being outside their metric's min and max",
+		},
+	)
+
+	badLabels = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "stdout2prom_bad_labels_total",
+			Help: "Total matches whose labels couldn't all be found",
+		},
+	)
+
+	disallowedValues = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "stdout2prom_disallowed_label_values_total",
+			Help: "Total label values that weren't in their allowedValues",
+		},
+	)
+
+	readErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "stdout2prom_read_errors_total",
+			Help: "Total errors reading the input",
+		},
+	)
+
+	scannerErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "stdout2prom_scanner_errors_total",
+			Help: "Total times the input couldn't be split into lines",
+		},
+	)
+
+	longLines = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "stdout2prom_long_lines_dropped_total",
+			Help: "Total lines dropped for being longer than the maximum line length",
+		},
+	)
+
+	ignoredLines = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "stdout2prom_ignored_lines_total",
+			Help: "Total lines skipped for matching one of the ignore regexes",
+		},
+	)
+
+	missingValueGroup = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "stdout2prom_missing_value_group_total",
+			Help: "Total matches where the value or a label's group, or field, wasn't in the line",
+		},
+	)
+
+	negativeAdds = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "stdout2prom_negative_adds_total",
+			Help: "Total negative values that were not added to a counter",
+		},
+	)
+
+	fifoReopens = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "stdout2prom_fifo_reopens_total",
+			Help: "Total times the fifo was reopened after the writer closed it",
+		},
+	)
+
+	droppedLines = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "stdout2prom_dropped_lines_total",
+			Help: "Total lines dropped as they arrived faster than they could be processed",
+		},
+	)
+
+	badTimestamps = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "stdout2prom_bad_timestamps_total",
+			Help: "Total lines whose timestamp failed to parse",
+		},
+	)
+
+	badSyslog = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "stdout2prom_syslog_malformed_total",
+			Help: "Total syslog messages that couldn't be parsed",
+		},
+	)
+
+	badJournal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "stdout2prom_journal_malformed_total",
+			Help: "Total journal entries that couldn't be parsed or had no text message",
+		},
+	)
+
+	journalRestarts = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "stdout2prom_journal_restarts_total",
+			Help: "Total times journalctl has had to be run again after stopping",
+		},
+	)
+
+	dockerReattaches = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "stdout2prom_docker_reattaches_total",
+			Help: "Total times we've reattached to the docker container's logs after it restarted",
+		},
+	)
+
+	authFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "stdout2prom_auth_failures_total",
+			Help: "Total requests refused for not having a username and password we know",
+		},
+	)
+
+	statsdErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "stdout2prom_statsd_errors_total",
+			Help: "Total updates that couldn't be sent to statsd, or were dropped as it had fallen behind",
+		},
+	)
+
+	remoteQueued = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "stdout2prom_remote_write_queued_samples",
+			Help: "Samples waiting to be sent with remote write",
+		},
+	)
+
+	remoteFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "stdout2prom_remote_write_failures_total",
+			Help: "Total remote writes that failed",
+		},
+	)
+
+	remoteDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "stdout2prom_remote_write_dropped_samples_total",
+			Help: "Total samples dropped without being sent with remote write",
+		},
+	)
+
+	inputConnections = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "stdout2prom_input_connections",
+			Help: "Number of connections sending us lines",
+		},
+	)
+
+	filesTailed = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "stdout2prom_files_tailed",
+			Help: "Number of input files being read",
+		},
+	)
+
+	reloadSuccess = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "stdout2prom_config_reload_success",
+			Help: "Whether the last config reload succeeded",
+		},
+	)
+
+	reloadTime = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "stdout2prom_config_last_reload_timestamp_seconds",
+			Help: "Timestamp of the last successful config reload",
+		},
+	)
+
+	startTime = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "stdout2prom_start_time_seconds",
+			Help: "Timestamp of when stdout2prom started",
+		},
+	)
 )
 
 func main() {
 
 	flag.Parse()
+	if *printVer {
+		fmt.Println(versionString())
+		return
+	}
+	startTime.SetToCurrentTime()
+	setLogFormat(*logFormat)
+	setPassthrough(*passTo)
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
-			log.Fatal(err)
+			logFatal(nil, "%v", err)
 		}
 		pprof.StartCPUProfile(f)
 		defer pprof.StopCPUProfile()
 	}
-	data, err := ioutil.ReadFile(*config)
+
+	if *check {
+		os.Exit(checkConfig(*config))
+	}
+	if *testCnf {
+		os.Exit(testConfig(*config))
+	}
+
+	var err error
+	cnf, err = loadConfig(*config)
+	if err != nil {
+		logFatal(nil, "Failed to load config, %v", err)
+	}
+	recordEnd, err = parseDelimiter(*delimiter)
 	if err != nil {
-		log.Fatalf("Failed to open config file, %v", err)
+		logFatal(nil, "Failed to parse -delimiter, %v", err)
+	}
+	if *dryRun {
+		if *dryRunFmt != "text" && *dryRunFmt != "json" {
+			logFatal(nil, "Bad dry run format %s, only text and json are supported", *dryRunFmt)
+		}
+		handleLine = dryRunLine
+		finished := make(chan struct{})
+		child := startReading(finished)
+		<-finished
+		dryRunSummary()
+		if child != nil && child.exitCode != 0 {
+			pprof.StopCPUProfile()
+			os.Exit(child.exitCode)
+		}
+		return
 	}
 
-	err = yaml.Unmarshal(data, &cnf)
+	err = registerMetrics(nil, cnf.Metrics)
 	if err != nil {
-		log.Fatalf("Failed to parse YAML file, %v", err)
+		logFatal(nil, "Failed to register metrics, %v", err)
+	}
+
+	//
+	// these our our own metrics to track what we processed
+	//
+	registerBuildInfo()
+	prometheus.MustRegister(totalLines)
+	prometheus.MustRegister(bytesRead)
+	prometheus.MustRegister(compressedBytes)
+	prometheus.MustRegister(matchedLines)
+	prometheus.MustRegister(unmatchedLines)
+	prometheus.MustRegister(skippedLines)
+	prometheus.MustRegister(notJSON)
+	prometheus.MustRegister(metricMatches)
+	prometheus.MustRegister(metricErrors)
+	prometheus.MustRegister(metricSeries)
+	if *profileRe {
+		prometheus.MustRegister(regexDuration)
 	}
+	prometheus.MustRegister(badFloats)
+	prometheus.MustRegister(badLabels)
+	prometheus.MustRegister(disallowedValues)
+	prometheus.MustRegister(outOfRange)
+	prometheus.MustRegister(badTimestamps)
+	prometheus.MustRegister(negativeAdds)
+	prometheus.MustRegister(missingValueGroup)
+	prometheus.MustRegister(readErrors)
+	prometheus.MustRegister(scannerErrors)
+	prometheus.MustRegister(longLines)
+	prometheus.MustRegister(ignoredLines)
+	prometheus.MustRegister(filesTailed)
+	prometheus.MustRegister(fifoReopens)
+	prometheus.MustRegister(inputConnections)
+	prometheus.MustRegister(droppedLines)
+	prometheus.MustRegister(badSyslog)
+	prometheus.MustRegister(badJournal)
+	prometheus.MustRegister(journalRestarts)
+	prometheus.MustRegister(dockerReattaches)
+	prometheus.MustRegister(authFailures)
+	prometheus.MustRegister(statsdErrors)
+	prometheus.MustRegister(remoteQueued)
+	prometheus.MustRegister(remoteFailures)
+	prometheus.MustRegister(remoteDropped)
+	prometheus.MustRegister(reloadSuccess)
+	prometheus.MustRegister(startTime)
+	prometheus.MustRegister(reloadTime)
+
+	// smaller scrapes without what the client library adds itself
+	if !cnf.GoMetrics {
+		prometheus.Unregister(prometheus.NewGoCollector())
+	}
+	if !cnf.ProcessMetrics {
+		prometheus.Unregister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	}
+
+	reloadSuccess.Set(1)
+	reloadTime.SetToCurrentTime()
+
+	go reapSeries()
+	startMatchers(*workers)
+
+	server := &http.Server{Addr: cnf.Listen, Handler: authenticate(http.DefaultServeMux)}
+	http.Handle(cnf.Path, scrapeTracker(metricsHandler(cnf.OpenMetrics)))
+	http.HandleFunc(cnf.HealthPath, healthHandler)
+	http.HandleFunc(cnf.ReadyPath, readyHandler)
+	if cnf.IngestPath != "" {
+		http.HandleFunc(cnf.IngestPath, ingestHandler)
+	}
+	if *lifecycle {
+		http.HandleFunc("/-/reload", reloadHandler)
+	}
+	if *unmatchedN > 0 {
+		unmatchedRing = newLineRing(*unmatchedN)
+		http.Handle("/debug/unmatched", unmatchedRing)
+	}
+
+	//
+	// Bind before we start reading stdin, so that a port that's
+	// in use stops us here rather than leaving us with no metrics.
+	// With nowhere to listen the pushgateway is all there is.
+	//
+	if cnf.Listen != "" {
+		listener, err := listen(cnf.Listen, cnf.ListenMode)
+		if err != nil {
+			logFatal(nil, "Failed to listen on %s, %v", cnf.Listen, err)
+		}
+		if *debug {
+			logDebug(nil, "Serving metrics on %s%s", listener.Addr(), cnf.Path)
+		}
+		if cnf.certificate != nil {
+			server.TLSConfig = tlsConfig()
+		}
+		go func() {
+			var err error
+			if server.TLSConfig != nil {
+				err = server.ServeTLS(listener, "", "")
+			} else {
+				err = server.Serve(listener)
+			}
+			if err != http.ErrServerClosed {
+				logFatal(nil, "Failed to serve metrics, %v", err)
+			}
+		}()
+	}
+	if *pushURL != "" {
+		go keepPushing(*pushURL, *pushEvery)
+	}
+	if cnf.RemoteWrite != nil {
+		go keepRemoteWriting(*cnf.RemoteWrite)
+	}
+	if cnf.StatsD != nil {
+		startStatsd(*cnf.StatsD)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	//
+	// Read the input in the background so that a signal can
+	// interrupt us while we are blocked waiting for a line. If
+	// we've been given a command, its output is our input.
+	//
+	if *posFile != "" && flag.NArg() == 0 && *listenIn == "" && *syslogIn == "" && !*journal && *container == "" && *fifo == "" {
+		loadPositions(*posFile)
+		go keepPositions(*posFile)
+	}
+	finished := make(chan struct{})
+	child := startReading(finished)
+
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			if child != nil {
+				child.signal(syscall.SIGHUP)
+			}
+			logInfo(nil, "Caught SIGHUP, reloading %s", *config)
+			err := reloadConfig()
+			if err != nil {
+				logError(nil, "Failed to reload config, keeping the old one, %v", err)
+			}
+		}
+	}()
+
+	// whether the child was told to stop rather than finishing itself
+	signalled := false
+
+	// whether the final values never got to the pushgateway
+	pushFailed := false
+
+wait:
+	for {
+		select {
+		case <-finished:
+			atomic.StoreInt32(&healthy, 0)
+			if *pushURL != "" && !finalPush(*pushURL, *pushTries) {
+				pushFailed = true
+			}
+			if signalled {
+				if *drain > 0 {
+					logInfo(nil, "Waiting up to %v for a final scrape", *drain)
+					if !waitForScrape(time.Now(), *drain, signals) {
+						logWarn(nil, "No final scrape, giving up")
+					}
+				}
+			} else if *waitScrape > 0 {
+				logInfo(nil, "Input closed, waiting up to %v for a scrape", *waitScrape)
+				if !waitForScrape(time.Now(), *waitScrape, signals) {
+					logWarn(nil, "No scrape, giving up")
+				}
+			} else if *tardy != 0 {
+				logInfo(nil, "Input closed, waiting %d seconds", *tardy)
+				select {
+				case <-time.After(time.Duration(*tardy*1000) * time.Millisecond):
+				case sig := <-signals:
+					logInfo(nil, "Caught %v, shutting down", sig)
+				}
+			}
+			break wait
+
+		case sig := <-signals:
+
+			//
+			// The child decides what to do about it, we carry on
+			// until it exits so nothing it writes is missed.
+			//
+			if child != nil {
+				child.signal(sig)
+				signalled = true
+				continue
+			}
+
+			logInfo(nil, "Caught %v, shutting down", sig)
+
+			//
+			// Finish what we've already read and don't take any
+			// more, then give prometheus a chance to see the final
+			// values.
+			//
+			if !stopReading(signals) {
+				break wait
+			}
+			atomic.StoreInt32(&healthy, 0)
+			if *pushURL != "" && !finalPush(*pushURL, *pushTries) {
+				pushFailed = true
+			}
+			if *drain > 0 {
+				logInfo(nil, "Waiting up to %v for a final scrape", *drain)
+				if !waitForScrape(time.Now(), *drain, signals) {
+					logWarn(nil, "No final scrape, giving up")
+				}
+			}
+			break wait
+		}
+	}
+
+	atomic.StoreInt32(&healthy, 0)
+	if *posFile != "" {
+		savePositions(*posFile)
+	}
+
+	//
+	// Let any scrapes in flight finish before we go.
+	//
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	if err != nil {
+		logError(nil, "Failed to shut down cleanly, %v", err)
+	}
+
+	// pass on how the child got on
+	if child != nil && child.exitCode != 0 {
+		pprof.StopCPUProfile()
+		os.Exit(child.exitCode)
+	}
+	if pushFailed {
+		logError(nil, "Failed to push the final values to %s", *pushURL)
+		pprof.StopCPUProfile()
+		os.Exit(1)
+	}
+
+}
+
+// processLine runs a single line of input against every metric and
+// replicates it to out unless it's been eaten. fields are labels
+// that came along with the line rather than from the regex.
+func processLine(line string, out io.Writer, fields prometheus.Labels) {
+	recordLine(line, out, fields)
+}
+
+// how many lines -sample has seen
+var sampled uint64
+
+// sampledOut is whether -sample skips this line, all but every Nth.
+func sampledOut() bool {
+	if *sample < 2 {
+		return false
+	}
+	return atomic.AddUint64(&sampled, 1)%uint64(*sample) != 0
+}
+
+// recordLine is processLine, also saying whether any metric matched.
+func recordLine(line string, out io.Writer, fields prometheus.Labels) bool {
+	cnfLock.RLock()
+	defer cnfLock.RUnlock()
+
+	atomic.StoreInt64(&lastLine, time.Now().UnixNano())
+	totalLines.Inc()
+	bytesRead.Add(float64(len(line)))
+
+	//
+	// Ignored lines never get near the metrics, they're only passed
+	// through if the config says so.
+	//
+	if cnf.ignores(line) {
+		ignoredLines.Inc()
+		if cnf.PassIgnored && !cnf.EatAll && !*quiet {
+			passLine(out, line)
+		}
+		return false
+	}
+
+	//
+	// Lines skipped by -sample aren't matched at all, so they're
+	// passed through, or not, as if they didn't match.
+	//
+	var matchFound, keep bool
+	if sampledOut() {
+		skippedLines.Inc()
+	} else {
+		if cnf.stopping {
+			// which metric is first only means anything in order
+			matchFound, keep = matchAll(line, cnf.Metrics, fields)
+		} else {
+			matchFound, keep = matchMetrics(line, cnf.Metrics, fields)
+		}
+		if matchFound {
+			matchedLines.Inc()
+		} else {
+			unmatchedLines.Inc()
+			if unmatchedRing != nil {
+				unmatchedRing.add(line)
+			}
+		}
+	}
+
+	//
+	// eatAll eats everything, eatMatches the lines that matched and
+	// eatUnmatched those that didn't, so with both nothing is left.
+	// A line is only eaten for matching if every metric it matched
+	// eats its matches.
+	//
+	if cnf.EatAll || *quiet {
+		return matchFound
+	}
+	if matchFound && !keep {
+		return matchFound
+	}
+	if !matchFound && cnf.EatUnmatched {
+		return matchFound
+	}
+	passLine(out, line)
+	return matchFound
+}
+
+// matchMetric runs a line against a single metric, updating it if
+// the line matches, and says whether it did.
+func matchMetric(metric *Metric, in *inputLine, fields prometheus.Labels) bool {
+	var value float64
+	var labels prometheus.Labels
+	var err error
+
+	if *debug {
+		logDebug(logFields{"metric": metric.Name, "line": in.text}, "Testing against metric [%s]", metric.Name)
+	}
+
+	//
+	// There are four types of metric
+	// Counter - goes up.
+	// Gauge - goes up and down.
+	// Histogram - observations counted into buckets.
+	// Summary - observations turned into quantiles.
+	//
+	// Any can have labels attached
+	//
+
+	result, groups := metric.match(in)
+
+	if len(result) == 0 {
+		return false
+	}
+
+	//
+	// An excluded line doesn't update the metric, it's only counted
+	// as matched, so it can be eaten, if the metric says so.
+	//
+	if metric.Excluded != nil && metric.Excluded.MatchString(in.text) {
+		if *debug {
+			logDebug(logFields{"metric": metric.Name, "line": in.text}, "Metric [%s] matched but the line is excluded, not updating", metric.Name)
+		}
+		return metric.EatExcluded
+	}
+
+	metricMatches.WithLabelValues(metric.Name).Inc()
+	if *debug {
+		logMatch(metric, in.text, result, groups)
+	}
+
+	//
+	// If we named our value, then search through
+	// the results for it.
+	//
+	if metric.Value != "" {
+		value, err = getValue(metric.Value,
+			groups,
+			result,
+			*metric.Scale,
+			metric.Offset,
+			metric.Min,
+			metric.Max)
+		if err == errMissingGroup {
+			countError(missingValueGroup, metric, "missing_group")
+			return true
+		} else if err == errOutOfRange {
+			countError(outOfRange, metric, "out_of_range")
+			return true
+		} else if err != nil {
+			countError(badFloats, metric, "bad_float")
+			return true
+		}
+
+		//
+		// Lines such as "released 2 connections" can
+		// take away from the value rather than add.
+		//
+		if metric.Negate != nil && metric.Negate.MatchString(in.text) {
+			value = -value
+		}
+		if *debug {
+			logDebug(logFields{"metric": metric.Name, "value": value}, "Value = %.4f", value)
+		}
+	}
+
+	//
+	// If we have labels to attach, search through
+	// the results and create a prometheus.Labels
+	// structure.
+	//
+	if len(metric.Labels) > 0 {
+		labels, err = getLabels(metric.Labels,
+			groups,
+			result,
+			fields,
+			metric.Rewrite,
+			metric.Allowed)
+		if err == errDisallowed {
+			countError(disallowedValues, metric, "disallowed_label")
+			return true
+		} else if err == errMissingGroup {
+			countError(missingValueGroup, metric, "missing_group")
+			return true
+		} else if err != nil {
+			countError(badLabels, metric, "bad_labels")
+			logError(logFields{"metric": metric.Name, "line": in.text}, "Metric %s, problems finding labels, %v", metric.Name, err)
+			return true
+		}
+	}
+
+	//
+	// Touch before updating, so the reaper can't delete
+	// a series between us updating and touching it.
+	//
+	if metric.Series != nil {
+		metric.Series.touch(labels)
+	}
+
+	//
+	// There is probably some coolkid golang way to
+	// this...
+	//
+	switch metric.Type {
+	case "counter":
+		// counters add the value if they have one,
+		// otherwise they count the match
+		if metric.Value == "" {
+			value = 1
+		}
+		// counters can only go up
+		if value < 0 {
+			countError(negativeAdds, metric, "negative_add")
+			if *debug {
+				logDebug(logFields{"metric": metric.Name, "line": in.text, "value": value}, "Negative value %.4f for counter", value)
+			}
+			return true
+		}
+		if len(metric.Labels) > 0 {
+			// counter + labels
+			metric.Collector.(*prometheus.CounterVec).With(labels).Add(value)
+			if *debug {
+				logDebug(logFields{"metric": metric.Name, "value": value}, "CounterVecLabels.Add(%.4f) [%+v]",
+					value, labels)
+			}
+		} else {
+			// counter
+			metric.Collector.(prometheus.Counter).Add(value)
+			if *debug {
+				logDebug(logFields{"metric": metric.Name, "value": value}, "Counter.Add(%.4f)", value)
+			}
+		}
+		sendStatsd(metric, labels, value, false)
+	case "gauge":
+		// gauges with their own timestamps are kept by us
+		if metric.Timestamp != "" {
+			at, err := getTimestamp(metric.Timestamp,
+				metric.TimeLayout,
+				groups,
+				result)
+			if err != nil {
+				countError(badTimestamps, metric, "bad_timestamp")
+				return true
+			}
+			metric.Collector.(*timestampedGauge).update(labels, value, metric.Mode == "add", at)
+			sendStatsd(metric, labels, value, metric.Mode == "add")
+			if *debug {
+				logDebug(logFields{"metric": metric.Name, "value": value}, "Gauge at %v (%.4f) [%+v]", at, value, labels)
+			}
+			return true
+		}
+
+		var gauge prometheus.Gauge
+		if len(metric.Labels) > 0 {
+			// gauge + labels + values
+			gauge = metric.Collector.(*prometheus.GaugeVec).With(labels)
+		} else {
+			// gauge + values
+			gauge = metric.Collector.(prometheus.Gauge)
+		}
+		if metric.Mode == "add" {
+			// move the gauge by the value
+			gauge.Add(value)
+			if *debug {
+				logDebug(logFields{"metric": metric.Name, "value": value}, "Gauge.Add(%.4f) [%+v]", value, labels)
+			}
+		} else {
+			gauge.Set(value)
+			if *debug {
+				logDebug(logFields{"metric": metric.Name, "value": value}, "Gauge.Set(%.4f) [%+v]", value, labels)
+			}
+		}
+		sendStatsd(metric, labels, value, metric.Mode == "add")
+	case "histogram":
+		if len(metric.Labels) > 0 {
+			// histogram + labels + values
+			metric.Collector.(*prometheus.HistogramVec).With(labels).Observe(value)
+			if *debug {
+				logDebug(logFields{"metric": metric.Name, "value": value}, "HistogramVecLabels.Observe(%.4f) [%+v]", value, labels)
+			}
+		} else {
+			// histogram + values
+			metric.Collector.(prometheus.Histogram).Observe(value)
+			if *debug {
+				logDebug(logFields{"metric": metric.Name, "value": value}, "Histogram.Observe(%.4f)", value)
+			}
+		}
+	case "summary":
+		if len(metric.Labels) > 0 {
+			// summary + labels + values
+			metric.Collector.(*prometheus.SummaryVec).With(labels).Observe(value)
+			if *debug {
+				logDebug(logFields{"metric": metric.Name, "value": value}, "SummaryVecLabels.Observe(%.4f) [%+v]", value, labels)
+			}
+		} else {
+			// summary + values
+			metric.Collector.(prometheus.Summary).Observe(value)
+			if *debug {
+				logDebug(logFields{"metric": metric.Name, "value": value}, "Summary.Observe(%.4f)", value)
+			}
+		}
+	}
+	return true
+}
+
+// loadConfig reads the config file, compiles the regexes and makes
+// a collector for each metric. Nothing is registered, so a broken
+// config can be thrown away without harm.
+func loadConfig(path string) (Data, error) {
+	c := defaults
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, fmt.Errorf("failed to open config file, %v", err)
+	}
+	if *expand {
+		data, err = expandEnv(data)
+		if err != nil {
+			return c, fmt.Errorf("failed to expand config file, %v", err)
+		}
+	}
+
+	err = yaml.Unmarshal(data, &c)
+	if err != nil {
+		return c, fmt.Errorf("failed to parse YAML file, %v", err)
+	}
+
+	var problems configError
+	if _, ok := c.Grouping["job"]; ok {
+		problems = append(problems, "grouping can't have job in it, that's set by job")
+	}
+	if c.RemoteWrite != nil {
+		if c.RemoteWrite.URL == "" {
+			problems = append(problems, "remoteWrite has no url")
+		}
+		if c.RemoteWrite.Interval < 0 || c.RemoteWrite.MaxSamples < 0 {
+			problems = append(problems, "remoteWrite can't have a negative interval or maxSamples")
+		}
+		if c.RemoteWrite.Interval == 0 {
+			c.RemoteWrite.Interval = 15 * time.Second
+		}
+		if c.RemoteWrite.MaxSamples == 0 {
+			c.RemoteWrite.MaxSamples = 100000
+		}
+	}
+	if c.StatsD != nil && c.StatsD.Address == "" {
+		problems = append(problems, "statsd has no address")
+	}
+	if c.Multiline != nil {
+		c.multiline, err = regexp.Compile(c.Multiline.StartPattern)
+		if c.Multiline.StartPattern == "" {
+			problems = append(problems, "multiline has no startPattern")
+		} else if err != nil {
+			problems = append(problems, fmt.Sprintf("multiline has a bad startPattern, %v", err))
+		}
+		if c.Multiline.MaxLines < 0 || c.Multiline.Timeout < 0 {
+			problems = append(problems, "multiline can't have a negative maxLines or timeout")
+		}
+		if c.Multiline.MaxLines == 0 {
+			c.Multiline.MaxLines = 500
+		}
+		if c.Multiline.Timeout == 0 {
+			c.Multiline.Timeout = time.Second
+		}
+		if c.IngestPath != "" {
+			problems = append(problems, "multiline can't join lines POSTed to ingestPath")
+		}
+	}
+	err = c.loadTLS()
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	if c.ListenMode != "" {
+		_, err := strconv.ParseUint(c.ListenMode, 8, 32)
+		if err != nil || !strings.HasPrefix(c.Listen, "unix://") {
+			problems = append(problems, fmt.Sprintf("listenMode %q must be octal, ie \"0660\", and is only for unix sockets", c.ListenMode))
+		}
+	}
+	for username, hash := range c.BasicAuthUsers {
+		_, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("basicAuthUsers %s doesn't have a bcrypt hash, %v", username, err))
+		}
+	}
+	c.ignored = nil
+	for _, regex := range c.Ignore {
+		compiled, err := regexp.Compile(regex)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("ignore has a bad regex %q, %v", regex, err))
+			continue
+		}
+		c.ignored = append(c.ignored, compiled)
+	}
+	c.stopping = false
+	c.patterns, err = loadPatterns(c.PatternsFile)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("failed to load patternsFile, %v", err))
+		c.patterns = basePatterns
+	}
+	automatic := c.automaticLabels()
+	for index, metric := range c.Metrics {
+
+		metricName := c.Basename + "_" + metric.Name
+		c.Metrics[index].FullName = metricName
+
+		// labels from the environment are really const labels
+		labels, fromEnv, byPosition := metric.Labels.split()
+		c.Metrics[index].Labels = labels
+		metric.Labels = labels
+
+		// a metric eats its matches if the config does, unless it
+		// says otherwise
+		c.Metrics[index].Eat = c.EatMatches
+		if metric.EatMatches != nil {
+			c.Metrics[index].Eat = *metric.EatMatches
+		}
+
+		// and the same for going on to the metrics after it
+		c.Metrics[index].Stop = c.StopOnFirst
+		if metric.Continue != nil {
+			c.Metrics[index].Stop = !*metric.Continue
+		}
+		if c.Metrics[index].Stop {
+			c.stopping = true
+		}
+		// format is another way of saying json or logfmt, or that the
+		// lines are an access log
+		switch metric.Format {
+		case "", "regex":
+		case "json":
+			metric.JSON = true
+		case "logfmt":
+			metric.Logfmt = true
+		case "combined":
+			if len(metric.Regex) > 0 {
+				problems = append(problems, fmt.Sprintf("metric %s can't have a regex with the combined format",
+					metric.Name))
+			}
+			metric.Regex = regexList{combinedRegex}
+		default:
+			problems = append(problems, fmt.Sprintf("metric %s has an unknown format %q, it can be regex, json, logfmt or combined",
+				metric.Name, metric.Format))
+		}
+		c.Metrics[index].JSON = metric.JSON
+		c.Metrics[index].Logfmt = metric.Logfmt
+		structured := metric.JSON || metric.Logfmt
+		if metric.JSON && metric.Logfmt {
+			problems = append(problems, fmt.Sprintf("metric %s can't be both json and logfmt",
+				metric.Name))
+		}
+		if structured && len(byPosition) > 0 {
+			problems = append(problems, fmt.Sprintf("metric %s can't have labels by group with json or logfmt",
+				metric.Name))
+		}
+		if len(metric.Regex) == 0 && !structured {
+			problems = append(problems, fmt.Sprintf("metric %s has no regex",
+				metric.Name))
+			continue
+		}
+
+		c.Metrics[index].Compiled = nil
+		c.Metrics[index].GroupIndex = nil
+		c.Metrics[index].Literals = nil
+		for _, regex := range metric.Regex {
+			expanded, err := c.patterns.expand(regex)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("metric %s regex %q has %v",
+					metric.Name, regex, err))
+				continue
+			}
+			// a metric matching multiline records as a whole wants .
+			// to match the newlines between their lines
+			if metric.Multiline {
+				expanded = "(?s)" + expanded
+			}
+			compiled, err := regexp.Compile(expanded)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("metric %s has a bad regex %q, %v",
+					metric.Name, regex, err))
+				continue
+			}
+			groupName := append([]string(nil), compiled.SubexpNames()...)
+
+			// labels given by position name their group
+			for name, group := range byPosition {
+				if group >= len(groupName) {
+					problems = append(problems, fmt.Sprintf("metric %s regex %q has no group %d for label %q",
+						metric.Name, regex, group, name))
+				} else if groupName[group] != "" && groupName[group] != name {
+					problems = append(problems, fmt.Sprintf("metric %s regex %q group %d is already named %q, not %q",
+						metric.Name, regex, group, groupName[group], name))
+				} else {
+					groupName[group] = name
+				}
+			}
+			c.Metrics[index].Compiled = append(c.Metrics[index].Compiled, compiled)
+			c.Metrics[index].GroupIndex = append(c.Metrics[index].GroupIndex,
+				groupIndex(groupName, metric.Value, metric.Timestamp))
+
+			// any match has to start with the literal prefix, so a
+			// line without it can be skipped without the regex
+			literal, _ := compiled.LiteralPrefix()
+			c.Metrics[index].Literals = append(c.Metrics[index].Literals, literal)
+
+			// a JSON or logfmt metric's regexes only pick which
+			// lines to look at
+			if structured {
+				continue
+			}
+
+			//
+			// Make sure what we'll be looking for is in every
+			// regex, otherwise we only find out when lines start
+			// matching.
+			//
+			if metric.Value != "" && indexOf(metric.Value, groupName) == -1 {
+				problems = append(problems, fmt.Sprintf("metric %s regex %q has no group named %q for its value",
+					metric.Name, regex, metric.Value))
+			}
+			if metric.Timestamp != "" && indexOf(metric.Timestamp, groupName) == -1 {
+				problems = append(problems, fmt.Sprintf("metric %s regex %q has no group named %q for its timestamp",
+					metric.Name, regex, metric.Timestamp))
+			}
+			for _, label := range metric.Labels {
+				if indexOf(label, groupName) != -1 || automatic[label] {
+					continue
+				}
+				switch label {
+				case c.StreamLabel:
+					problems = append(problems, fmt.Sprintf("metric %s regex %q has no group named %q and only a command's or container's output has streams",
+						metric.Name, regex, label))
+				case c.FileLabel:
+					problems = append(problems, fmt.Sprintf("metric %s regex %q has no group named %q and only files have names",
+						metric.Name, regex, label))
+				case c.ContainerLabel:
+					problems = append(problems, fmt.Sprintf("metric %s regex %q has no group named %q and only containers have names",
+						metric.Name, regex, label))
+				case c.RemoteLabel:
+					problems = append(problems, fmt.Sprintf("metric %s regex %q has no group named %q and only lines from the network have a remote address",
+						metric.Name, regex, label))
+				default:
+					problems = append(problems, fmt.Sprintf("metric %s regex %q has no group named %q for its label",
+						metric.Name, regex, label))
+				}
+			}
+		}
+
+		//
+		// A JSON or logfmt metric's value and labels are paths to
+		// fields or keys, the labels are named after them.
+		//
+		c.Metrics[index].FieldIndex = nil
+		c.Metrics[index].FieldPaths = nil
+		if structured {
+			fieldNames := []string{""}
+			if metric.Value != "" {
+				fieldNames = append(fieldNames, metric.Value)
+				c.Metrics[index].FieldPaths = append(c.Metrics[index].FieldPaths, metric.Value)
+			}
+			if metric.Timestamp != "" {
+				fieldNames = append(fieldNames, metric.Timestamp)
+				c.Metrics[index].FieldPaths = append(c.Metrics[index].FieldPaths, metric.Timestamp)
+			}
+			for i, label := range metric.Labels {
+				if automatic[label] {
+					continue
+				}
+				name := labelName(label)
+				fieldNames = append(fieldNames, name)
+				c.Metrics[index].FieldPaths = append(c.Metrics[index].FieldPaths, label)
+				metric.Labels[i] = name
+			}
+			c.Metrics[index].FieldIndex = groupIndex(fieldNames)
+		}
+
+		//
+		// Only lines whose fields have the values in match count,
+		// each is a regex that has to match the whole value.
+		//
+		c.Metrics[index].Matchers = nil
+		if len(metric.Match) > 0 && !structured {
+			problems = append(problems, fmt.Sprintf("metric %s can only have match with json or logfmt",
+				metric.Name))
+		}
+		paths := make([]string, 0, len(metric.Match))
+		for path := range metric.Match {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			compiled, err := regexp.Compile("^(?:" + metric.Match[path] + ")$")
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("metric %s has a bad match for %s, %v",
+					metric.Name, path, err))
+				continue
+			}
+			c.Metrics[index].Matchers = append(c.Metrics[index].Matchers, fieldMatcher{path, compiled})
+		}
+		problems = append(problems, c.Metrics[index].compileRewrites()...)
+		problems = append(problems, c.Metrics[index].compileAllowlist()...)
+
+		//
+		// Global const labels apply to every metric, unless the
+		// metric has its own with the same name.
+		//
+		if len(c.ConstLabels) > 0 {
+			merged := prometheus.Labels{}
+			for name, value := range c.ConstLabels {
+				merged[name] = value
+			}
+			for name, value := range metric.ConstLabels {
+				merged[name] = value
+			}
+			c.Metrics[index].ConstLabels = merged
+			metric.ConstLabels = merged
+		}
+		if len(fromEnv) > 0 {
+			merged := prometheus.Labels{}
+			for name, value := range metric.ConstLabels {
+				merged[name] = value
+			}
+			for name, value := range fromEnv {
+				if _, ok := merged[name]; ok {
+					problems = append(problems, fmt.Sprintf("metric %s has %q as both a label from the environment and a const label",
+						metric.Name, name))
+				}
+				merged[name] = value
+			}
+			c.Metrics[index].ConstLabels = merged
+			metric.ConstLabels = merged
+		}
+
+		for _, label := range metric.Labels {
+			if _, ok := metric.ConstLabels[label]; ok {
+				problems = append(problems, fmt.Sprintf("metric %s has %q as both a label and a const label",
+					metric.Name, label))
+			}
+		}
+
+		if metric.Min != nil && metric.Max != nil && *metric.Min > *metric.Max {
+			problems = append(problems, fmt.Sprintf("metric %s has a min bigger than its max",
+				metric.Name))
+		}
+
+		if metric.NegateOn != "" {
+			c.Metrics[index].Negate, err = regexp.Compile(metric.NegateOn)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("metric %s has a bad negateOn, %v",
+					metric.Name, err))
+			}
+		}
+
+		if metric.Exclude != "" {
+			c.Metrics[index].Excluded, err = regexp.Compile(metric.Exclude)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("metric %s has a bad exclude, %v",
+					metric.Name, err))
+			}
+		} else if metric.EatExcluded {
+			problems = append(problems, fmt.Sprintf("metric %s has eatExcluded but no exclude",
+				metric.Name))
+		}
+
+		// a pointer so that a scale of 0 isn't mistaken for unset
+		if metric.Scale == nil {
+			scale := 1.0
+			c.Metrics[index].Scale = &scale
+		}
+
+		if *debug {
+			logDebug(logFields{"metric": metric.Name}, "Added metric for %s", metricName)
+		}
+
+		//
+		// Older configs didn't have a type, a value meant a gauge
+		// and no value meant a counter.
+		//
+		if metric.Type == "" {
+			if metric.Value != "" {
+				c.Metrics[index].Type = "gauge"
+			} else {
+				c.Metrics[index].Type = "counter"
+			}
+			metric.Type = c.Metrics[index].Type
+			logWarn(logFields{"metric": metric.Name}, "Metric %s has no type, assuming %s, this is deprecated",
+				metric.Name, metric.Type)
+		}
+
+		switch metric.Type {
+		case "counter":
+
+			if len(metric.Labels) > 0 {
+				c.Metrics[index].Collector = prometheus.NewCounterVec(
+					prometheus.CounterOpts{
+						Name:        metricName,
+						Help:        metric.Description,
+						ConstLabels: metric.ConstLabels,
+					},
+					metric.Labels,
+				)
+				if *debug {
+					logDebug(logFields{"metric": metric.Name}, "   Type CounterVec")
+				}
+			} else {
+				c.Metrics[index].Collector = prometheus.NewCounter(
+					prometheus.CounterOpts{
+						Name:        metricName,
+						Help:        metric.Description,
+						ConstLabels: metric.ConstLabels,
+					})
+				if *debug {
+					logDebug(logFields{"metric": metric.Name}, "   Type Counter")
+				}
+			}
+
+		case "gauge":
+
+			// a gauge needs something to set
+			if metric.Value == "" {
+				problems = append(problems, fmt.Sprintf("metric %s is a gauge but has no value",
+					metric.Name))
+			}
+			if metric.Mode != "" && metric.Mode != "set" && metric.Mode != "add" {
+				problems = append(problems, fmt.Sprintf("metric %s has unknown mode %q",
+					metric.Name, metric.Mode))
+			}
+
+			if metric.Timestamp != "" {
+				if metric.TimeLayout == "" {
+					c.Metrics[index].TimeLayout = time.RFC3339
+				}
+				c.Metrics[index].Collector = newTimestampedGauge(
+					prometheus.GaugeOpts{
+						Name:        metricName,
+						Help:        metric.Description,
+						ConstLabels: metric.ConstLabels,
+					},
+					metric.Labels,
+				)
+				if *debug {
+					logDebug(logFields{"metric": metric.Name}, "   Type Gauge with timestamps")
+				}
+				break
+			}
+
+			// metrics that have labels
+			if len(metric.Labels) > 0 {
+				c.Metrics[index].Collector = prometheus.NewGaugeVec(
+					prometheus.GaugeOpts{
+						Name:        metricName,
+						Help:        metric.Description,
+						ConstLabels: metric.ConstLabels,
+					},
+					metric.Labels,
+				)
+				if *debug {
+					logDebug(logFields{"metric": metric.Name}, "   Type GaugeVec")
+				}
+
+			} else {
+				c.Metrics[index].Collector = prometheus.NewGauge(
+					prometheus.GaugeOpts{
+						Name:        metricName,
+						Help:        metric.Description,
+						ConstLabels: metric.ConstLabels,
+					})
+				if *debug {
+					logDebug(logFields{"metric": metric.Name}, "   Type Gauge")
+				}
+			}
 
-	for index, metric := range cnf.Metrics {
+		case "histogram":
 
-		metricName := cnf.Basename + "_" + metric.Name
-		cnf.Metrics[index].Compiled = regexp.MustCompile(metric.Regex)
-		cnf.Metrics[index].GroupName = cnf.Metrics[index].Compiled.SubexpNames()
+			// a histogram needs something to observe
+			if metric.Value == "" {
+				problems = append(problems, fmt.Sprintf("metric %s is a histogram but has no value",
+					metric.Name))
+			}
+			if len(metric.Buckets) == 0 {
+				c.Metrics[index].Buckets = prometheus.DefBuckets
+			}
 
-		if *debug {
-			log.Printf("Added metric for %s\n", metricName)
-		}
-		if metric.Value != "" {
+			//
+			// The client panics rather than returning an error for
+			// these, which would take us down on a reload.
+			//
+			broken := false
+			for i := 1; i < len(metric.Buckets); i++ {
+				if metric.Buckets[i] <= metric.Buckets[i-1] {
+					problems = append(problems, fmt.Sprintf("metric %s has buckets that don't go up, %v after %v",
+						metric.Name, metric.Buckets[i], metric.Buckets[i-1]))
+					broken = true
+					break
+				}
+			}
+			if hasLabel(metric, "le") {
+				problems = append(problems, fmt.Sprintf("metric %s is a histogram so can't have a label named \"le\"",
+					metric.Name))
+				broken = true
+			}
+			if broken {
+				break
+			}
 
-			// metrics that have labels
 			if len(metric.Labels) > 0 {
-				cnf.Metrics[index].Collector = prometheus.NewGaugeVec(
-					prometheus.GaugeOpts{
-						Name: metricName,
-						Help: metric.Description,
+				c.Metrics[index].Collector = prometheus.NewHistogramVec(
+					prometheus.HistogramOpts{
+						Name:        metricName,
+						Help:        metric.Description,
+						ConstLabels: metric.ConstLabels,
+						Buckets:     c.Metrics[index].Buckets,
 					},
 					metric.Labels,
 				)
 				if *debug {
-					log.Println("   Type GaugeVec")
+					logDebug(logFields{"metric": metric.Name}, "   Type HistogramVec")
 				}
-
 			} else {
-				cnf.Metrics[index].Collector = prometheus.NewGauge(
-					prometheus.GaugeOpts{
-						Name: metricName,
-						Help: metric.Description,
+				c.Metrics[index].Collector = prometheus.NewHistogram(
+					prometheus.HistogramOpts{
+						Name:        metricName,
+						Help:        metric.Description,
+						ConstLabels: metric.ConstLabels,
+						Buckets:     c.Metrics[index].Buckets,
 					})
 				if *debug {
-					log.Println("   Type Gauge")
+					logDebug(logFields{"metric": metric.Name}, "   Type Histogram")
 				}
 			}
 
-		} else {
+		case "summary":
+
+			// a summary needs something to observe
+			if metric.Value == "" {
+				problems = append(problems, fmt.Sprintf("metric %s is a summary but has no value",
+					metric.Name))
+			}
+			for quantile := range metric.Objectives {
+				if quantile < 0 || quantile > 1 {
+					problems = append(problems, fmt.Sprintf("metric %s has objective quantile %v outside 0..1",
+						metric.Name, quantile))
+				}
+			}
+
+			// more things the client panics over
+			broken := false
+			if metric.MaxAge < 0 {
+				problems = append(problems, fmt.Sprintf("metric %s has a negative maxAge",
+					metric.Name))
+				broken = true
+			}
+			if hasLabel(metric, "quantile") {
+				problems = append(problems, fmt.Sprintf("metric %s is a summary so can't have a label named \"quantile\"",
+					metric.Name))
+				broken = true
+			}
+			if broken {
+				break
+			}
 
 			if len(metric.Labels) > 0 {
-				cnf.Metrics[index].Collector = prometheus.NewCounterVec(
-					prometheus.CounterOpts{
-						Name: metricName,
-						Help: metric.Description,
+				c.Metrics[index].Collector = prometheus.NewSummaryVec(
+					prometheus.SummaryOpts{
+						Name:        metricName,
+						Help:        metric.Description,
+						ConstLabels: metric.ConstLabels,
+						Objectives:  metric.Objectives,
+						MaxAge:      metric.MaxAge,
 					},
 					metric.Labels,
 				)
 				if *debug {
-					log.Println("   Type CounterVec")
+					logDebug(logFields{"metric": metric.Name}, "   Type SummaryVec")
 				}
 			} else {
-				cnf.Metrics[index].Collector = prometheus.NewCounter(
-					prometheus.CounterOpts{
-						Name: metricName,
-						Help: metric.Description,
+				c.Metrics[index].Collector = prometheus.NewSummary(
+					prometheus.SummaryOpts{
+						Name:        metricName,
+						Help:        metric.Description,
+						ConstLabels: metric.ConstLabels,
+						Objectives:  metric.Objectives,
+						MaxAge:      metric.MaxAge,
 					})
 				if *debug {
-					log.Println("   Type Counter")
+					logDebug(logFields{"metric": metric.Name}, "   Type Summary")
 				}
 			}
+
+		default:
+			problems = append(problems, fmt.Sprintf("metric %s has unknown type %q",
+				metric.Name, metric.Type))
+		}
+
+		if metric.Type != "gauge" && metric.Mode != "" {
+			problems = append(problems, fmt.Sprintf("metric %s has a mode but only gauges have modes",
+				metric.Name))
+		}
+		if metric.Multiline && c.Multiline == nil {
+			problems = append(problems, fmt.Sprintf("metric %s is multiline but there's no multiline to join lines into records",
+				metric.Name))
+		}
+		if metric.Type != "gauge" && metric.Timestamp != "" {
+			problems = append(problems, fmt.Sprintf("metric %s has a timestamp but only gauges have timestamps",
+				metric.Name))
 		}
 
-		prometheus.MustRegister(cnf.Metrics[index].Collector)
+		// only labelled metrics have series that can go stale
+		if metric.TTL > 0 {
+			if len(metric.Labels) == 0 {
+				problems = append(problems, fmt.Sprintf("metric %s has a ttl but no labels",
+					metric.Name))
+			}
+			c.Metrics[index].Series = newSeriesTracker()
+		}
 
 		if *debug {
-			log.Printf("   Value group name is %s\n", cnf.Metrics[index].Value)
-			log.Printf("   Labels are %v\n", cnf.Metrics[index].Labels)
+			logDebug(logFields{"metric": metric.Name}, "   Value group name is %s", c.Metrics[index].Value)
+			logDebug(logFields{"metric": metric.Name}, "   Labels are %v", c.Metrics[index].Labels)
 		}
 
 	}
 
 	//
-	// these our our own metrics to track what we processed
+	// The HTTP mux panics over a bad or repeated path.
 	//
-	prometheus.MustRegister(totalLines)
-	prometheus.MustRegister(bytesRead)
-	prometheus.MustRegister(matchedLines)
+	paths := []struct{ name, path string }{
+		{"path", c.Path},
+		{"healthPath", c.HealthPath},
+		{"readyPath", c.ReadyPath},
+	}
+	if c.IngestPath != "" {
+		paths = append(paths, struct{ name, path string }{"ingestPath", c.IngestPath})
+	}
+	if *lifecycle {
+		paths = append(paths, struct{ name, path string }{"the reload endpoint", "/-/reload"})
+	}
+	seen := map[string]string{}
+	for _, p := range paths {
+		if !strings.HasPrefix(p.path, "/") {
+			problems = append(problems, fmt.Sprintf("%s %q doesn't start with a /",
+				p.name, p.path))
+			continue
+		}
+		if other, ok := seen[p.path]; ok {
+			problems = append(problems, fmt.Sprintf("%s %q is the same as %s",
+				p.name, p.path, other))
+			continue
+		}
+		seen[p.path] = p.name
+	}
 
-	http.Handle(cnf.Path, prometheus.Handler())
-	go http.ListenAndServe(cnf.Listen, nil)
+	if len(problems) > 0 {
+		return c, problems
+	}
+	return c, nil
+}
+
+// hasLabel says whether a metric has a label or const label called
+// name.
+func hasLabel(metric Metric, name string) bool {
+	if _, ok := metric.ConstLabels[name]; ok {
+		return true
+	}
+	return indexOf(name, metric.Labels) != -1
+}
 
-	scanner := bufio.NewScanner(os.Stdin)
-	for scanner.Scan() {
-		line := scanner.Text()
+// automaticLabels are the names of labels that come along with a
+// line rather than from a metric's regex, for the input we've been
+// given. Only a command's or container's output has streams, only
+// files have a file name, only containers have a container name, only
+// lines from the network have a remote address, only syslog messages
+// have syslog fields and only journal entries have journal fields.
+func (c Data) automaticLabels() map[string]bool {
+	automatic := map[string]bool{}
+	command := flag.NArg() > 0
+	network := !command && (*listenIn != "" || *syslogIn != "")
+	docker := !command && !network && !*journal && *container != ""
+	if c.StreamLabel != "" && (command || docker) {
+		automatic[c.StreamLabel] = true
+	}
+	if c.FileLabel != "" && !command && !network && !*journal && !docker && (*fifo != "" || *input != "-") {
+		automatic[c.FileLabel] = true
+	}
+	if c.ContainerLabel != "" && docker {
+		automatic[c.ContainerLabel] = true
+	}
+	if c.RemoteLabel != "" && network {
+		automatic[c.RemoteLabel] = true
+	}
+	if !command && *listenIn == "" && *syslogIn != "" {
+		for _, name := range syslogFields {
+			automatic[name] = true
+		}
+	}
+	if !command && !network && *journal {
+		for _, name := range journalFields {
+			automatic[name] = true
+		}
+	}
+	return automatic
+}
 
-		totalLines.Inc()
-		bytesRead.Add(float64(len(line)))
-		matchFound := false
+// ignores is whether the line matches any of the ignore regexes.
+func (c *Data) ignores(line string) bool {
+	for _, compiled := range c.ignored {
+		if compiled.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
 
-		for _, metric := range cnf.Metrics {
+// regexList is the regexes for a metric, or to ignore, the config
+// can give either a single regex or a list of them.
+type regexList []string
 
-			if *debug {
-				log.Printf("Testing against metric [%s]\n", metric.Name)
+func (r *regexList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single string
+	err := unmarshal(&single)
+	if err == nil {
+		*r = regexList{single}
+		return nil
+	}
+
+	var list []string
+	err = unmarshal(&list)
+	if err != nil {
+		return err
+	}
+	*r = list
+	return nil
+}
+
+// labelList is the labels for a metric. Each is either the name of a
+// group, a label whose value comes from the environment, ie
+// `{name: region, fromEnv: AWS_REGION, default: unknown}`, or a label
+// whose value is the group at a position, ie `{name: status, group: 2}`.
+// Those from the environment are looked up as the config is read and
+// kept as "name=value", and those by position as "name$2", until
+// split out.
+type labelList []string
+
+// labelSpec is a label from the environment or by position. Without a
+// default an environment variable has to be set.
+type labelSpec struct {
+	Name    string  `yaml:"name"`
+	FromEnv string  `yaml:"fromEnv"`
+	Default *string `yaml:"default"`
+	Group   *int    `yaml:"group"`
+}
+
+// labelItem is a single label of a labelList.
+type labelItem string
+
+func (l *labelItem) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	err := unmarshal(&name)
+	if err == nil {
+		*l = labelItem(name)
+		return nil
+	}
+
+	var env labelSpec
+	err = unmarshal(&env)
+	if err != nil {
+		return err
+	}
+	if env.Name != "" && env.Group != nil && env.FromEnv == "" {
+		if *env.Group < 0 {
+			return fmt.Errorf("label %s has a negative group", env.Name)
+		}
+		*l = labelItem(env.Name + "$" + strconv.Itoa(*env.Group))
+		return nil
+	}
+	if env.Name == "" || env.FromEnv == "" {
+		return fmt.Errorf("a label needs a name and either fromEnv or group")
+	}
+	value, ok := os.LookupEnv(env.FromEnv)
+	if !ok {
+		if env.Default == nil {
+			return fmt.Errorf("label %s is from $%s, which isn't set and there's no default",
+				env.Name, env.FromEnv)
+		}
+		value = *env.Default
+	}
+	*l = labelItem(env.Name + "=" + value)
+	return nil
+}
+
+func (l *labelList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var items []labelItem
+	err := unmarshal(&items)
+	if err != nil {
+		return err
+	}
+	*l = nil
+	for _, item := range items {
+		*l = append(*l, string(item))
+	}
+	return nil
+}
+
+// split separates the labels from the environment, and their values,
+// from the rest, and finds the positions of those given by position.
+func (l labelList) split() (labelList, prometheus.Labels, map[string]int) {
+	var labels labelList
+	fromEnv := prometheus.Labels{}
+	byPosition := map[string]int{}
+	for _, label := range l {
+		if equals := strings.IndexByte(label, '='); equals != -1 {
+			fromEnv[label[:equals]] = label[equals+1:]
+			continue
+		}
+		if dollar := strings.IndexByte(label, '$'); dollar != -1 {
+			byPosition[label[:dollar]], _ = strconv.Atoi(label[dollar+1:])
+			label = label[:dollar]
+		}
+		labels = append(labels, label)
+	}
+	return labels, fromEnv, byPosition
+}
+
+// match tries each of the metric's regexes in turn, returning the
+// submatches and group names of the first one that matches. JSON and
+// logfmt metrics return their fields instead.
+func (m *Metric) match(line *inputLine) ([]string, map[string]int) {
+	if m.MustContain != "" && !strings.Contains(line.text, m.MustContain) {
+		return nil, nil
+	}
+	if m.JSON || m.Logfmt {
+		return m.matchFields(line)
+	}
+	for index, compiled := range m.Compiled {
+		if !m.mightMatch(index, line.text) {
+			continue
+		}
+		var result []string
+		if *profileRe {
+			started := time.Now()
+			result = compiled.FindStringSubmatch(line.text)
+			regexDuration.WithLabelValues(m.Name).Observe(time.Since(started).Seconds())
+		} else {
+			result = compiled.FindStringSubmatch(line.text)
+		}
+		if len(result) != 0 {
+			return result, m.GroupIndex[index]
+		}
+	}
+	return nil, nil
+}
+
+// mightMatch is whether the metric's regex could match the line,
+// checking for its literal prefix being a lot quicker than running it.
+func (m *Metric) mightMatch(index int, text string) bool {
+	return strings.Contains(text, m.Literals[index])
+}
+
+// configError is every problem found while loading a config.
+type configError []string
+
+func (e configError) Error() string {
+	return strings.Join(e, ", ")
+}
+
+// checkConfig loads the config file and reports anything wrong with
+// it, returning the exit code. Nothing is registered or listened on.
+func checkConfig(path string) int {
+	c, err := loadConfig(path)
+
+	var problems []string
+	if errs, ok := err.(configError); ok {
+		problems = append(problems, errs...)
+	} else if err != nil {
+		fmt.Printf("%s: %v\n", path, err)
+		return 1
+	}
+	problems = append(problems, lintConfig(c)...)
+
+	if len(problems) > 0 {
+		fmt.Printf("%s: %d problems found\n", path, len(problems))
+		for _, problem := range problems {
+			fmt.Printf("  %s\n", problem)
+		}
+		return 1
+	}
+	fmt.Printf("%s: OK, %d metrics\n", path, len(c.Metrics))
+	return 0
+}
+
+var (
+	metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRE  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// lintConfig finds problems that only show up when the metrics are
+// registered.
+func lintConfig(c Data) []string {
+	var problems []string
+	seen := map[string]bool{}
+
+	for _, metric := range c.Metrics {
+		if !metricNameRE.MatchString(metric.FullName) {
+			problems = append(problems, fmt.Sprintf("metric %s has an invalid name %q",
+				metric.Name, metric.FullName))
+		}
+		if seen[metric.FullName] {
+			problems = append(problems, fmt.Sprintf("metric %s is defined more than once",
+				metric.Name))
+		}
+		seen[metric.FullName] = true
+
+		for _, label := range metric.Labels {
+			if !labelNameRE.MatchString(label) || strings.HasPrefix(label, "__") {
+				problems = append(problems, fmt.Sprintf("metric %s has an invalid label name %q",
+					metric.Name, label))
 			}
+		}
+	}
 
-			//
-			// There are two types of metric
-			// Gauge - goes up and down.
-			// Counter - goes up or down.
-			//
-			// Either can have labels attached
-			//
+	return problems
+}
 
-			result := metric.Compiled.FindStringSubmatch(line)
+// reloadConfig swaps the running config for a freshly loaded one,
+// leaving the old one in place if anything is wrong with the new.
+func reloadConfig() error {
+	newCnf, err := loadConfig(*config)
+	if err == nil {
+		cnfLock.Lock()
+		err = registerMetrics(cnf.Metrics, newCnf.Metrics)
+		if err == nil {
+			// the http server is already up
+			if newCnf.Listen != cnf.Listen || newCnf.ListenMode != cnf.ListenMode || newCnf.Path != cnf.Path ||
+				newCnf.HealthPath != cnf.HealthPath || newCnf.ReadyPath != cnf.ReadyPath ||
+				newCnf.IngestPath != cnf.IngestPath || newCnf.OpenMetrics != cnf.OpenMetrics ||
+				newCnf.GoMetrics != cnf.GoMetrics || newCnf.ProcessMetrics != cnf.ProcessMetrics {
+				logWarn(nil, "Changes to listen, paths and what's served need a restart")
+			}
+			newCnf.Listen = cnf.Listen
+			newCnf.ListenMode = cnf.ListenMode
+			newCnf.Path = cnf.Path
+			newCnf.HealthPath = cnf.HealthPath
+			newCnf.ReadyPath = cnf.ReadyPath
+			newCnf.IngestPath = cnf.IngestPath
+			newCnf.OpenMetrics = cnf.OpenMetrics
+			newCnf.GoMetrics = cnf.GoMetrics
+			newCnf.ProcessMetrics = cnf.ProcessMetrics
 
-			if len(result) != 0 {
+			// certificates can be changed, but not turning TLS on or off
+			if (newCnf.certificate == nil) != (cnf.certificate == nil) {
+				logWarn(nil, "Turning TLS on or off needs a restart")
+				newCnf.TLSCertFile = cnf.TLSCertFile
+				newCnf.TLSKeyFile = cnf.TLSKeyFile
+				newCnf.TLSClientCAFile = cnf.TLSClientCAFile
+				newCnf.certificate = cnf.certificate
+				newCnf.clientCAs = cnf.clientCAs
+			}
 
-				matchedLines.Inc()
-				matchFound = true
-				if *debug {
-					log.Printf(" ** Match **\n")
-				}
+			// as are remote write, statsd and how lines are read
+			if !reflect.DeepEqual(newCnf.RemoteWrite, cnf.RemoteWrite) ||
+				!reflect.DeepEqual(newCnf.StatsD, cnf.StatsD) ||
+				!reflect.DeepEqual(newCnf.Multiline, cnf.Multiline) {
+				logWarn(nil, "Changes to remoteWrite, statsd and multiline need a restart")
+			}
+			newCnf.RemoteWrite = cnf.RemoteWrite
+			newCnf.StatsD = cnf.StatsD
+			newCnf.Multiline = cnf.Multiline
+			newCnf.multiline = cnf.multiline
+			cnf = newCnf
+		}
+		cnfLock.Unlock()
+	}
 
-				//
-				// If we named our value, then search through
-				// the results for it.
-				//
-				if metric.Value != "" {
-					value, err = getValue(metric.Value,
-						metric.GroupName,
-						result)
-					if err != nil {
-						badFloats.Inc()
-						continue
-					}
-					if *debug {
-						log.Printf("Value = %.4f\n", value)
-					}
-				}
+	if err != nil {
+		reloadSuccess.Set(0)
+		return err
+	}
+	reloadSuccess.Set(1)
+	reloadTime.SetToCurrentTime()
+	logInfo(nil, "Reloaded %s, %d metrics", *config, len(newCnf.Metrics))
+	return nil
+}
 
-				//
-				// If we have labels to attach, search through
-				// the results and create a prometheus.Labels
-				// structure.
-				//
-				if len(metric.Labels) > 0 {
-					labels, err = getLabels(metric.Labels,
-						metric.GroupName,
-						result)
-					if err != nil {
-						log.Println("problems finding labels")
-					}
-				}
+// scrapeTracker notes when each completed scrape of the metrics
+// started, so a scrape that began before some event doesn't count as
+// having seen the values after it.
+func scrapeTracker(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		handler.ServeHTTP(w, r)
+		atomic.StoreInt64(&lastScrape, started.UnixNano())
+	})
+}
 
-				//
-				// There is probably some coolkid golang way to
-				// this...
-				//
-				if metric.Value == "" {
-					// counter
-					if len(metric.Labels) > 0 {
-						// counter + labels
-						metric.Collector.(*prometheus.CounterVec).With(labels).Inc()
-						if *debug {
-							log.Printf("CounterVecLabels.Inc() [%+v]\n",
-								labels)
-						}
-					} else {
-						// counter
-						metric.Collector.(prometheus.Counter).Inc()
-						if *debug {
-							log.Printf("CounterVec.Inc()\n")
-						}
-					}
-				} else {
-					// gauge
-					if len(metric.Labels) > 0 {
-						// gauge + labels + values
-						metric.Collector.(*prometheus.GaugeVec).With(labels).Set(value)
-						if *debug {
-							log.Printf("GaugeVecLabels.Set(%.4f) [%+v]\n", value, labels)
-						}
-					} else {
-						// gauge + values
-						metric.Collector.(prometheus.Gauge).Set(value)
-						if *debug {
-							log.Printf("GaugeVec.Set(%.4f)\n", value, labels)
-						}
-					}
+// metricsHandler serves everything registered, in the OpenMetrics
+// format if openMetrics is set and the scraper asks for it.
+func metricsHandler(openMetrics bool) http.Handler {
+	return promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{
+		EnableOpenMetrics: openMetrics,
+	})
+}
+
+// healthHandler says whether we're still working on the input.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&healthy) == 0 {
+		http.Error(w, "Input closed", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "OK")
+}
+
+// readyHandler says whether lines are still arriving, so something
+// can notice if whatever feeds us has stalled.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	cnfLock.RLock()
+	within := cnf.ReadyWithin
+	cnfLock.RUnlock()
+
+	last := time.Unix(0, atomic.LoadInt64(&lastLine))
+	if time.Since(last) > within {
+		http.Error(w, fmt.Sprintf("No lines read in the last %v", within),
+			http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "OK")
+}
+
+// waitForScrape waits until the metrics have been scraped since the
+// given time, returning false if the timeout passes or a signal
+// arrives first.
+func waitForScrape(since time.Time, timeout time.Duration, signals chan os.Signal) bool {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.After(timeout)
+
+	for {
+		if atomic.LoadInt64(&lastScrape) > since.UnixNano() {
+			return true
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return false
+		case sig := <-signals:
+			logInfo(nil, "Caught %v, not waiting any longer", sig)
+			return false
+		}
+	}
+}
+
+// reloadHandler reloads the config when POSTed to.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	logInfo(nil, "Reload requested by %s, reloading %s", r.RemoteAddr, *config)
+	err := reloadConfig()
+	if err != nil {
+		logError(nil, "Failed to reload config, keeping the old one, %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "OK")
+}
+
+// where the metrics are registered and gathered from, the tests give
+// each of theirs a registry of its own
+var (
+	registerer prometheus.Registerer = prometheus.DefaultRegisterer
+	gatherer   prometheus.Gatherer   = prometheus.DefaultGatherer
+)
 
+// registerMetrics registers the collectors of the new metrics and
+// unregisters the old ones. Where a new metric is the same as an old
+// one the old collector is kept, so its values survive a reload. If
+// anything fails to register the old metrics are put back.
+func registerMetrics(old []Metric, new []Metric) error {
+	kept := map[prometheus.Collector]bool{}
+	for index := range new {
+		for _, metric := range old {
+			if !kept[metric.Collector] && sameCollector(metric, new[index]) {
+				new[index].Collector = metric.Collector
+				if new[index].Series != nil && metric.Series != nil {
+					new[index].Series = metric.Series
 				}
-			} // for metrics
+				kept[metric.Collector] = true
+				break
+			}
+		}
+	}
 
-		} // len(result) != 0
+	var removed []prometheus.Collector
+	for _, metric := range old {
+		if !kept[metric.Collector] {
+			registerer.Unregister(metric.Collector)
+			removed = append(removed, metric.Collector)
+		}
+	}
 
-		if cnf.EatAll {
+	var added []prometheus.Collector
+	for _, metric := range new {
+		if kept[metric.Collector] {
 			continue
 		}
-		if matchFound && cnf.EatMatches {
-			continue
+		err := registerer.Register(metric.Collector)
+		if err != nil {
+			for _, collector := range added {
+				registerer.Unregister(collector)
+			}
+			for _, collector := range removed {
+				registerer.MustRegister(collector)
+			}
+			return fmt.Errorf("failed to register metric %s, %v", metric.Name, err)
 		}
-		fmt.Println(line)
-
-	} // for scanner
+		added = append(added, metric.Collector)
+	}
 
-	if *tardy != 0 {
-		log.Printf("Stdin closed, waiting %d seconds", *tardy)
-		time.Sleep(time.Duration(*tardy*1000) * time.Millisecond)
+	//
+	// Every metric's matches start at zero, so one that never
+	// matches can be told apart from one that doesn't exist.
+	//
+	names := map[string]bool{}
+	for _, metric := range new {
+		metricMatches.WithLabelValues(metric.Name)
+		names[metric.Name] = true
+	}
+	for _, metric := range old {
+		if !names[metric.Name] {
+			metricMatches.DeleteLabelValues(metric.Name)
+			for _, reason := range errorReasons {
+				metricErrors.DeleteLabelValues(metric.Name, reason)
+			}
+		}
 	}
 
+	return nil
+}
+
+// sameCollector is true if the two metrics would make identical
+// collectors.
+func sameCollector(a Metric, b Metric) bool {
+	return a.FullName == b.FullName &&
+		a.Description == b.Description &&
+		a.Type == b.Type &&
+		reflect.DeepEqual(a.Labels, b.Labels) &&
+		reflect.DeepEqual(a.ConstLabels, b.ConstLabels) &&
+		reflect.DeepEqual(a.Buckets, b.Buckets) &&
+		reflect.DeepEqual(a.Objectives, b.Objectives) &&
+		a.MaxAge == b.MaxAge &&
+		(a.Timestamp == "") == (b.Timestamp == "")
+}
+
+// errorReasons are the reasons in stdout2prom_metric_errors_total.
+var errorReasons = []string{"missing_group", "out_of_range", "bad_float", "bad_labels", "disallowed_label", "negative_add", "bad_timestamp"}
+
+// countError counts a match the metric couldn't use, in the total for
+// that kind of error and against the metric.
+func countError(total prometheus.Counter, metric *Metric, reason string) {
+	total.Inc()
+	metricErrors.WithLabelValues(metric.Name, reason).Inc()
 }
 
+var errMissingGroup = errors.New("couldn't find value in results")
+var errOutOfRange = errors.New("value is out of range")
+
 func getValue(valueName string,
-	groupNames []string,
-	results []string) (float64, error) {
+	groups map[string]int,
+	results []string,
+	scale float64,
+	offset float64,
+	min *float64,
+	max *float64) (float64, error) {
 	//
 	// find the index of this value in the list of groups
 	//
-	idx := indexOf(valueName, groupNames)
+	idx, ok := groups[valueName]
+	if !ok {
+		return 0.0, errMissingGroup
+	}
 
 	//
 	// grab it from the results, convert it to a float
@@ -326,12 +2256,26 @@ func getValue(valueName string,
 	if err != nil {
 		return 0.0, err
 	}
-	return value, nil
+
+	//
+	// throw away anything silly, ie from a clock going backwards
+	//
+	if (min != nil && value < *min) || (max != nil && value > *max) {
+		return 0.0, errOutOfRange
+	}
+
+	//
+	// transform it, ie milliseconds into seconds
+	//
+	return value*scale + offset, nil
 }
 
 func getLabels(labelNames []string,
-	groupNames []string,
-	results []string) (prometheus.Labels, error) {
+	groups map[string]int,
+	results []string,
+	fields prometheus.Labels,
+	rewrites labelRewrites,
+	allowed *labelAllowlist) (prometheus.Labels, error) {
 
 	value := prometheus.Labels{}
 
@@ -339,21 +2283,56 @@ func getLabels(labelNames []string,
 		//
 		// find the index of this label in the list of groups
 		//
-		idx := indexOf(labelName, groupNames)
-		if idx == -1 {
-			return nil, errors.New("couldn't find label in results")
+		idx, ok := groups[labelName]
+		if !ok {
+			//
+			// it might be one that came along with the line
+			//
+			field, ok := fields[labelName]
+			if !ok {
+				return nil, errMissingGroup
+			}
+			value[labelName] = rewriteLabel(field, rewrites[labelName])
+			continue
 		}
 
 		//
-		// grab it from the results, bung it in the value struct
+		// grab it from the results, tidy it up, bung it in the
+		// value struct
 		//
-		value[labelName] = results[idx]
+		value[labelName] = rewriteLabel(results[idx], rewrites[labelName])
 	}
 
-	return value, nil
+	return value, allowed.check(value)
+}
+
+// groupIndex maps the names of a regex's groups to their positions,
+// so finding one for a line is a lookup. Any of the names given that
+// are positions, ie "$2", are put in too.
+func groupIndex(groupName []string, names ...string) map[string]int {
+	index := map[string]int{}
+	for position, name := range groupName {
+		if name != "" {
+			index[name] = position
+		}
+	}
+	for _, name := range names {
+		if position := indexOf(name, groupName); name != "" && position != -1 {
+			index[name] = position
+		}
+	}
+	return index
 }
 
 func indexOf(word string, data []string) int {
+	// a group can be given by its position, ie "$2" or "2"
+	if word != "" && (word[0] == '$' || word[0] >= '0' && word[0] <= '9') {
+		position, err := strconv.Atoi(strings.TrimPrefix(word, "$"))
+		if err != nil || position < 0 || position >= len(data) {
+			return -1
+		}
+		return position
+	}
 	for k, v := range data {
 		if word == v {
 			return k
@@ -361,3 +2340,132 @@ func indexOf(word string, data []string) int {
 	}
 	return -1
 }
+
+// seriesTracker remembers when each label set of a metric was last
+// updated, so that series that have gone quiet can be deleted.
+type seriesTracker struct {
+	sync.Mutex
+	lastSeen map[string]time.Time
+	labels   map[string]prometheus.Labels
+}
+
+func newSeriesTracker() *seriesTracker {
+	return &seriesTracker{
+		lastSeen: map[string]time.Time{},
+		labels:   map[string]prometheus.Labels{},
+	}
+}
+
+func (s *seriesTracker) touch(labels prometheus.Labels) {
+	key := labelsKey(labels)
+
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.labels[key]; !ok {
+		// copy, the caller may reuse the map
+		copied := prometheus.Labels{}
+		for k, v := range labels {
+			copied[k] = v
+		}
+		s.labels[key] = copied
+	}
+	s.lastSeen[key] = time.Now()
+}
+
+// expire calls remove for each label set that hasn't been touched
+// within the ttl and forgets about it. remove is called with the
+// lock held so that a touch can't sneak in between.
+func (s *seriesTracker) expire(ttl time.Duration, remove func(prometheus.Labels)) {
+	cutoff := time.Now().Add(-ttl)
+
+	s.Lock()
+	defer s.Unlock()
+	for key, seen := range s.lastSeen {
+		if seen.Before(cutoff) {
+			remove(s.labels[key])
+			delete(s.lastSeen, key)
+			delete(s.labels, key)
+		}
+	}
+}
+
+// reapSeries deletes labelled series that have not been updated
+// within their metric's ttl.
+func reapSeries() {
+	for range time.Tick(time.Second) {
+		cnfLock.RLock()
+		for _, metric := range cnf.Metrics {
+			if metric.Series == nil {
+				continue
+			}
+			vec, ok := metric.Collector.(interface {
+				Delete(prometheus.Labels) bool
+			})
+			if !ok {
+				continue
+			}
+			name := metric.Name
+			metric.Series.expire(metric.TTL, func(labels prometheus.Labels) {
+				vec.Delete(labels)
+				if *debug {
+					logDebug(logFields{"metric": name, "labels": labels}, "Expired %s %+v", name, labels)
+				}
+			})
+		}
+		cnfLock.RUnlock()
+	}
+}
+
+// seriesCounter is stdout2prom_metric_series, how many series each
+// labelled metric has. They're counted from its collector when we're
+// scraped, so matching lines doesn't have to keep track.
+type seriesCounter struct {
+	desc *prometheus.Desc
+}
+
+func newSeriesCounter() *seriesCounter {
+	return &seriesCounter{
+		desc: prometheus.NewDesc("stdout2prom_metric_series",
+			"Distinct label sets each labelled metric has", []string{"metric"}, nil),
+	}
+}
+
+func (s *seriesCounter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.desc
+}
+
+func (s *seriesCounter) Collect(ch chan<- prometheus.Metric) {
+	cnfLock.RLock()
+	defer cnfLock.RUnlock()
+	for _, metric := range cnf.Metrics {
+		if len(metric.Labels) == 0 || metric.Collector == nil {
+			continue
+		}
+		collector := metric.Collector
+		series := make(chan prometheus.Metric)
+		go func() {
+			collector.Collect(series)
+			close(series)
+		}()
+		count := 0
+		for range series {
+			count++
+		}
+		ch <- prometheus.MustNewConstMetric(s.desc, prometheus.GaugeValue,
+			float64(count), metric.Name)
+	}
+}
+
+func labelsKey(labels prometheus.Labels) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, name+"="+labels[name])
+	}
+	return strings.Join(parts, "\xff")
+}
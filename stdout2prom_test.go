@@ -0,0 +1,581 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadTestConfig makes cnf from the given config.
+func loadTestConfig(t testing.TB, config string) {
+	file, err := ioutil.TempFile("", "stdout2prom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(config)
+	file.Close()
+
+	cnf, err = loadConfig(file.Name())
+	if err != nil {
+		t.Fatalf("Failed to load config, %v", err)
+	}
+}
+
+// useRegistry has the metrics registered in a registry of the test's
+// own, so they can be registered again when it runs again.
+func useRegistry(t *testing.T) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registerer, gatherer = registry, registry
+	t.Cleanup(func() {
+		registerer, gatherer = prometheus.DefaultRegisterer, prometheus.DefaultGatherer
+	})
+	return registry
+}
+
+// A value that won't parse should show up in the bad floats counter
+// on a scrape.
+func TestBadFloatsScraped(t *testing.T) {
+	loadTestConfig(t, `basename: test
+metrics:
+  - name: temperature
+    description: Temperature
+    type: gauge
+    regex: 'temperature=(?P<temp>\S+)'
+    value: temp
+`)
+	useRegistry(t).MustRegister(badFloats)
+	err := registerMetrics(nil, cnf.Metrics)
+	if err != nil {
+		t.Fatalf("Failed to register metrics, %v", err)
+	}
+	bad := scrapedValue(t, "stdout2prom_bad_floats_total")
+
+	processLine("temperature=warm", ioutil.Discard, nil)
+
+	if value := scrapedValue(t, "stdout2prom_bad_floats_total"); value != bad+1 {
+		t.Errorf("Expected stdout2prom_bad_floats_total %g in the scrape, got %g", bad+1, value)
+	}
+}
+
+// Metrics should come out in both the classic text format and, if
+// it's asked for, OpenMetrics.
+func TestScrapeFormats(t *testing.T) {
+	loadTestConfig(t, `basename: formats
+openMetrics: true
+metrics:
+  - name: requests_total
+    description: Requests
+    type: counter
+    regex: 'status=(?P<status>\d+)'
+    labels: [status]
+`)
+	useRegistry(t)
+	err := registerMetrics(nil, cnf.Metrics)
+	if err != nil {
+		t.Fatalf("Failed to register metrics, %v", err)
+	}
+
+	processLine("status=200", ioutil.Discard, nil)
+
+	formats := []struct {
+		accept, contentType, expected string
+	}{
+		{"", "text/plain", `formats_requests_total{status="200"} 1`},
+		{"application/openmetrics-text; version=0.0.1", "application/openmetrics-text", `formats_requests_total{status="200"} 1`},
+	}
+	for _, format := range formats {
+		request := httptest.NewRequest("GET", "/metrics", nil)
+		if format.accept != "" {
+			request.Header.Set("Accept", format.accept)
+		}
+		scrape := httptest.NewRecorder()
+		metricsHandler(cnf.OpenMetrics).ServeHTTP(scrape, request)
+
+		contentType := scrape.Header().Get("Content-Type")
+		if !strings.HasPrefix(contentType, format.contentType) {
+			t.Errorf("Expected a %s scrape, got %s", format.contentType, contentType)
+		}
+		if !strings.Contains(scrape.Body.String(), format.expected) {
+			t.Errorf("Expected %s in the %s scrape, got\n%s",
+				format.expected, format.contentType, scrape.Body.String())
+		}
+	}
+}
+
+// With stopOnFirstMatch a line only updates the first metric, in the
+// order of the config, that it matches, unless that one continues,
+// and is only counted as matched once.
+func TestStopOnFirstMatch(t *testing.T) {
+	loadTestConfig(t, `basename: first
+stopOnFirstMatch: true
+metrics:
+  - name: errors
+    type: counter
+    regex: 'ERROR'
+    continue: true
+  - name: disk_errors
+    type: counter
+    regex: 'ERROR disk'
+  - name: disk_lines
+    type: counter
+    regex: 'disk'
+`)
+	useRegistry(t).MustRegister(matchedLines)
+	err := registerMetrics(nil, cnf.Metrics)
+	if err != nil {
+		t.Fatalf("Failed to register metrics, %v", err)
+	}
+	matched := scrapedValue(t, "stdout2prom_matched_lines_total")
+
+	processLine("ERROR disk full", ioutil.Discard, nil)
+
+	for name, expected := range map[string]float64{
+		"first_errors":                    1,
+		"first_disk_errors":               1,
+		"first_disk_lines":                0,
+		"stdout2prom_matched_lines_total": matched + 1,
+	} {
+		if value := scrapedValue(t, name); value != expected {
+			t.Errorf("Expected %s %g in the scrape, got %g", name, expected, value)
+		}
+	}
+}
+
+// The combined format should pick the fields out of real Apache and
+// nginx access log lines.
+func TestCombinedFormat(t *testing.T) {
+	loadTestConfig(t, `basename: access
+metrics:
+  - name: requests_total
+    type: counter
+    format: combined
+    labels: [remote_addr, method, path, status, bytes, referer, user_agent]
+  - name: request_seconds
+    type: histogram
+    format: combined
+    value: request_time
+    labels: [status]
+`)
+
+	lines := []struct {
+		line   string
+		labels prometheus.Labels
+		took   float64
+	}{
+		{
+			line: `127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 [en] (Win98; I ;Nav)"`,
+			labels: prometheus.Labels{"remote_addr": "127.0.0.1", "method": "GET", "path": "/apache_pb.gif",
+				"status": "200", "bytes": "2326", "referer": "http://www.example.com/start.html",
+				"user_agent": "Mozilla/4.08 [en] (Win98; I ;Nav)"},
+		},
+		{
+			line: `2001:db8::1 - - [16/Oct/2026:08:01:02 +0000] "POST /api/v1/users?page=2 HTTP/2.0" 503 - "-" "curl/8.4.0 \"quoted\" agent" 0.125`,
+			labels: prometheus.Labels{"remote_addr": "2001:db8::1", "method": "POST", "path": "/api/v1/users?page=2",
+				"status": "503", "bytes": "", "referer": "-", "user_agent": `curl/8.4.0 \"quoted\" agent`},
+			took: 0.125,
+		},
+		{
+			line: `203.0.113.9 - - [16/Oct/2026:08:01:03 +0000] "\x16\x03\x01" 400 157 "-" "-" 0.001`,
+			labels: prometheus.Labels{"remote_addr": "203.0.113.9", "method": "", "path": "",
+				"status": "400", "bytes": "157", "referer": "-", "user_agent": "-"},
+			took: 0.001,
+		},
+	}
+	for _, test := range lines {
+		requests := tryMetric(&cnf.Metrics[0], &inputLine{text: test.line}, nil)
+		if requests == nil || requests.Error != "" {
+			t.Errorf("Expected %q to match, got %+v", test.line, requests)
+			continue
+		}
+		for name, expected := range test.labels {
+			if requests.Labels[name] != expected {
+				t.Errorf("Expected %s %q from %q, got %q", name, expected, test.line, requests.Labels[name])
+			}
+		}
+
+		if test.took == 0 {
+			continue
+		}
+		seconds := tryMetric(&cnf.Metrics[1], &inputLine{text: test.line}, nil)
+		if seconds == nil || seconds.Value == nil || *seconds.Value != test.took {
+			t.Errorf("Expected a request_time of %g from %q, got %+v", test.took, test.line, seconds)
+		}
+	}
+
+	if tryMetric(&cnf.Metrics[0], &inputLine{text: "GET /index.html 200"}, nil) != nil {
+		t.Errorf("Expected a line that isn't an access log not to match")
+	}
+}
+
+// Each labelled metric's distinct label sets are counted for
+// stdout2prom_metric_series when it's scraped.
+func TestSeriesCounted(t *testing.T) {
+	loadTestConfig(t, `basename: series
+metrics:
+  - name: requests_total
+    type: counter
+    regex: 'status=(?P<status>\d+)'
+    labels: [status]
+  - name: lines_total
+    type: counter
+    regex: 'status='
+`)
+	useRegistry(t).MustRegister(metricSeries)
+	err := registerMetrics(nil, cnf.Metrics)
+	if err != nil {
+		t.Fatalf("Failed to register metrics, %v", err)
+	}
+
+	for _, line := range []string{"status=200", "status=404", "status=200"} {
+		processLine(line, ioutil.Discard, nil)
+	}
+
+	const series = `stdout2prom_metric_series{metric="requests_total"}`
+	if value := scrapedValue(t, series); value != 2 {
+		t.Errorf("Expected %s 2 in the scrape, got %g", series, value)
+	}
+
+	scrape := httptest.NewRecorder()
+	metricsHandler(false).ServeHTTP(scrape, httptest.NewRequest("GET", "/metrics", nil))
+	if strings.Contains(scrape.Body.String(), `metric="lines_total"`) {
+		t.Errorf("Expected lines_total, without labels, not to count series, got\n%s",
+			scrape.Body.String())
+	}
+}
+
+// A multiline record is matched as one, with . matching across its
+// lines for a multiline metric, but still passed through as the lines it was made of and in
+// the order they came, including a record finished by the timeout.
+func TestMultilineOrder(t *testing.T) {
+	loadTestConfig(t, `basename: multi
+multiline:
+  startPattern: '^\S'
+  timeout: 50ms
+metrics:
+  - name: exceptions_total
+    type: counter
+    regex: '^\S+Exception: .*\sat com\.example\.'
+    multiline: true
+  - name: lines_total
+    type: counter
+    regex: '^INFO .*'
+`)
+	useRegistry(t)
+	err := registerMetrics(nil, cnf.Metrics)
+	if err != nil {
+		t.Fatalf("Failed to register metrics, %v", err)
+	}
+
+	first := "INFO starting\n" +
+		"java.lang.IllegalStateException: boom\n" +
+		"\tat com.example.App.run(App.java:10)\n" +
+		"\tat com.example.App.main(App.java:5)\n"
+	second := "INFO still going\n" +
+		"java.io.IOException: disk full\n" +
+		"\tat com.example.Disk.write(Disk.java:42)\n"
+
+	reader, writer := io.Pipe()
+	var out bytes.Buffer
+	done := make(chan struct{})
+	go func() {
+		readLines(reader, &out, nil)
+		close(done)
+	}()
+
+	// the exception is the last record until the timeout flushes it
+	io.WriteString(writer, first)
+	time.Sleep(200 * time.Millisecond)
+	processing.Lock()
+	flushed := out.String()
+	processing.Unlock()
+	if flushed != first {
+		t.Errorf("Expected the timeout to pass through\n%q\ngot\n%q", first, flushed)
+	}
+
+	io.WriteString(writer, second)
+	writer.Close()
+	<-done
+
+	if out.String() != first+second {
+		t.Errorf("Expected the lines passed through in order\n%q\ngot\n%q", first+second, out.String())
+	}
+	if value := scrapedValue(t, "multi_exceptions_total"); value != 2 {
+		t.Errorf("Expected multi_exceptions_total 2 in the scrape, got %g", value)
+	}
+	if value := scrapedValue(t, "multi_lines_total"); value != 2 {
+		t.Errorf("Expected multi_lines_total 2 in the scrape, got %g", value)
+	}
+}
+
+// A logfmt or JSON line without the value's or a label's key is
+// counted as a missing group, the same as for a regex.
+func TestMissingKeyCounted(t *testing.T) {
+	loadTestConfig(t, `basename: missing
+metrics:
+  - name: duration_seconds
+    type: gauge
+    format: logfmt
+    value: duration
+    labels: [path]
+`)
+	useRegistry(t).MustRegister(missingValueGroup, metricErrors)
+	err := registerMetrics(nil, cnf.Metrics)
+	if err != nil {
+		t.Fatalf("Failed to register metrics, %v", err)
+	}
+	const errors = `stdout2prom_metric_errors_total{metric="duration_seconds",reason="missing_group"}`
+	missing := scrapedValue(t, "stdout2prom_missing_value_group_total")
+	counted := scrapedValue(t, errors)
+
+	processLine(`level=info path=/api msg="no duration"`, ioutil.Discard, nil)
+	processLine(`level=info duration=1.5 msg="no path"`, ioutil.Discard, nil)
+	processLine(`level=info path=/api duration=0.25`, ioutil.Discard, nil)
+
+	if value := scrapedValue(t, "stdout2prom_missing_value_group_total"); value != missing+2 {
+		t.Errorf("Expected stdout2prom_missing_value_group_total %g in the scrape, got %g", missing+2, value)
+	}
+	if value := scrapedValue(t, errors); value != counted+2 {
+		t.Errorf("Expected %s %g in the scrape, got %g", errors, counted+2, value)
+	}
+	if value := scrapedValue(t, `missing_duration_seconds{path="/api"}`); value != 0.25 {
+		t.Errorf("Expected only the line with both keys to set the gauge, got %g", value)
+	}
+}
+
+// Lines longer than maxLineLength are dropped and counted, even when
+// they're short enough to fit in the scanner's buffer.
+func TestLongLinesDropped(t *testing.T) {
+	loadTestConfig(t, `basename: long
+maxLineLength: 100
+metrics:
+  - name: lines_total
+    type: counter
+    regex: 'x'
+`)
+	useRegistry(t).MustRegister(longLines)
+	dropped := scrapedValue(t, "stdout2prom_long_lines_dropped_total")
+
+	longest := strings.Repeat("x", 100)
+	input := "short\n" + strings.Repeat("x", 101) + "\n" + longest + "\n" +
+		strings.Repeat("x", 5000) + "\nlast\n" + strings.Repeat("x", 150)
+	var out bytes.Buffer
+	readLines(strings.NewReader(input), &out, nil)
+
+	if out.String() != "short\n"+longest+"\nlast\n" {
+		t.Errorf("Expected only the lines up to 100 bytes passed through, got %q", out.String())
+	}
+	if value := scrapedValue(t, "stdout2prom_long_lines_dropped_total"); value != dropped+3 {
+		t.Errorf("Expected stdout2prom_long_lines_dropped_total %g in the scrape, got %g", dropped+3, value)
+	}
+}
+
+// When the remote end rejects a remote write, only the samples it
+// doesn't like are dropped, the rest still get there.
+func TestRemoteWriteDropsRejected(t *testing.T) {
+	accepted := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		// the snappy block is all literals, so the labels are in it
+		if bytes.Contains(body, []byte("out_of_order")) {
+			http.Error(w, "out of order sample", http.StatusBadRequest)
+			return
+		}
+		accepted += bytes.Count(body, []byte("__name__"))
+	}))
+	defer server.Close()
+
+	var samples []remoteSample
+	for i := 0; i < 7; i++ {
+		name := fmt.Sprintf("sample%d", i)
+		if i == 2 || i == 5 {
+			name = "out_of_order"
+		}
+		samples = append(samples, remoteSample{
+			labels: []remoteLabel{{"__name__", name}},
+			value:  float64(i),
+		})
+	}
+
+	rw := RemoteWrite{URL: server.URL, Interval: time.Second}
+	unsent, dropped, err := rw.sendSplitting(samples)
+	if _, ok := err.(remoteRejected); !ok {
+		t.Errorf("Expected the rejection as the error, got %v", err)
+	}
+	if len(unsent) != 0 || dropped != 2 || accepted != 5 {
+		t.Errorf("Expected 5 samples accepted and 2 dropped, got %d accepted, %d dropped and %d unsent",
+			accepted, dropped, len(unsent))
+	}
+}
+
+// A JSON metric's rewrites and allowed values can be given for the
+// paths of its labels, and a line with anything after the object
+// isn't JSON.
+func TestJSONLabelPaths(t *testing.T) {
+	loadTestConfig(t, `basename: paths
+metrics:
+  - name: requests_total
+    type: counter
+    format: json
+    labels: [http.status, http.method]
+    rewrite:
+      http.status: [{match: '5\d\d', replacement: 5xx}]
+    allowedValues:
+      http.method: [GET, POST]
+`)
+
+	match := tryMetric(&cnf.Metrics[0], &inputLine{text: `{"http": {"status": 503, "method": "PURGE"}}`}, nil)
+	if match == nil || match.Labels["http_status"] != "5xx" || match.Labels["http_method"] != "other" {
+		t.Errorf("Expected http_status 5xx and http_method other, got %+v", match)
+	}
+
+	for _, line := range []string{
+		`{"http": {"status": 200, "method": "GET"}} trailing`,
+		`{"http": {"status": 200, "method": "GET"}}}`,
+		`{"http": {"status": 200, "method": "GET"}} {"http": {}}`,
+	} {
+		if match := tryMetric(&cnf.Metrics[0], &inputLine{text: line}, nil); match != nil {
+			t.Errorf("Expected %q not to be JSON, got %+v", line, match)
+		}
+	}
+}
+
+// Logging as JSON, each entry has the level it was logged at and the
+// fields it was given.
+func TestJSONLogLevels(t *testing.T) {
+	var out bytes.Buffer
+	logger = &jsonLog{out: &out}
+	defer func() { logger = nil }()
+
+	logError(logFields{"metric": "requests_total", "line": "GET /"}, "Bad things")
+	logInfo(nil, "Failed is only a word")
+
+	decoder := json.NewDecoder(&out)
+	for _, expected := range []map[string]string{
+		{"level": "error", "msg": "Bad things", "metric": "requests_total", "line": "GET /"},
+		{"level": "info", "msg": "Failed is only a word"},
+	} {
+		entry := map[string]string{}
+		if err := decoder.Decode(&entry); err != nil {
+			t.Fatalf("Failed to decode log entry, %v", err)
+		}
+		for name, value := range expected {
+			if entry[name] != value {
+				t.Errorf("Expected %s %q, got %q", name, value, entry[name])
+			}
+		}
+	}
+}
+
+// scrapedValue scrapes the metrics and finds the value of the named
+// series, or 0 if it isn't there.
+func scrapedValue(t *testing.T, name string) float64 {
+	scrape := httptest.NewRecorder()
+	metricsHandler(false).ServeHTTP(scrape, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range strings.Split(scrape.Body.String(), "\n") {
+		if strings.HasPrefix(line, name+" ") {
+			value, err := strconv.ParseFloat(strings.TrimPrefix(line, name+" "), 64)
+			if err != nil {
+				t.Fatalf("Failed to parse %q, %v", line, err)
+			}
+			return value
+		}
+	}
+	return 0
+}
+
+// benchmarkProcessLine runs lines through 64 metrics, with the given
+// number of matchers.
+func benchmarkProcessLine(b *testing.B, matchers int) {
+	benchmarkLines(b, matchers, true, func(i int) string {
+		return fmt.Sprintf("GET path=/api/v%d/users status=200 took=12ms", i%64)
+	})
+}
+
+// benchmarkLines runs the lines made by line through 64 metrics, with
+// the given number of matchers, and without checking for each regex's
+// literal prefix first unless prefilter is set.
+func benchmarkLines(b *testing.B, matchers int, prefilter bool, line func(i int) string) {
+	config := "basename: bench\nmetrics:\n"
+	for i := 0; i < 64; i++ {
+		config += fmt.Sprintf(`  - name: requests%d
+    type: counter
+    regex: 'path=/api/v%d/(?P<endpoint>\w+) status=(?P<status>\d+)'
+    labels: [endpoint, status]
+`, i, i)
+	}
+	loadTestConfig(b, config)
+	if !prefilter {
+		// every line contains the empty string
+		for index := range cnf.Metrics {
+			for i := range cnf.Metrics[index].Literals {
+				cnf.Metrics[index].Literals[i] = ""
+			}
+		}
+	}
+
+	matchJobs = nil
+	startMatchers(matchers)
+	defer func() {
+		if matchJobs != nil {
+			close(matchJobs)
+			matchJobs = nil
+		}
+	}()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		processLine(line(i), ioutil.Discard, nil)
+	}
+}
+
+func BenchmarkProcessLineOneMatcher(b *testing.B) {
+	benchmarkProcessLine(b, 1)
+}
+
+func BenchmarkProcessLineFourMatchers(b *testing.B) {
+	benchmarkProcessLine(b, 4)
+}
+
+func BenchmarkProcessLineEightMatchers(b *testing.B) {
+	benchmarkProcessLine(b, 8)
+}
+
+// Most lines in a real log don't match any metric.
+func BenchmarkProcessLineNoMatch(b *testing.B) {
+	benchmarkLines(b, 1, true, noMatchLine)
+}
+
+func BenchmarkProcessLineNoMatchUnfiltered(b *testing.B) {
+	benchmarkLines(b, 1, false, noMatchLine)
+}
+
+func noMatchLine(i int) string {
+	return fmt.Sprintf("10.0.0.%d - - GET /static/app%d.js HTTP/1.1 200 5120", i%256, i)
+}
+
+// A more realistic log, where one line in sixteen is for the API.
+func BenchmarkProcessLineMixed(b *testing.B) {
+	benchmarkLines(b, 1, true, mixedLine)
+}
+
+func BenchmarkProcessLineMixedUnfiltered(b *testing.B) {
+	benchmarkLines(b, 1, false, mixedLine)
+}
+
+func mixedLine(i int) string {
+	if i%16 == 0 {
+		return fmt.Sprintf("10.0.0.%d GET path=/api/v%d/users status=200 took=12ms", i%256, i%64)
+	}
+	return noMatchLine(i)
+}
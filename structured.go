@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// inputLine is a line of input. It's only parsed as JSON or logfmt
+// if a metric wants it, and then only the once however many metrics
+// do.
+type inputLine struct {
+	text string
+
+	jsonParsed bool
+	json       map[string]interface{}
+
+	logfmtParsed bool
+	logfmt       map[string]string
+}
+
+// jsonFields is the line parsed as a JSON object, or nil if it isn't
+// one. A line that doesn't even start like one isn't parsed at all.
+func (l *inputLine) jsonFields() map[string]interface{} {
+	if !l.jsonParsed {
+		l.jsonParsed = true
+		trimmed := strings.TrimLeft(l.text, " \t")
+		if trimmed != "" && trimmed[0] == '{' {
+			decoder := json.NewDecoder(strings.NewReader(trimmed))
+			decoder.UseNumber()
+			var fields map[string]interface{}
+			if decoder.Decode(&fields) == nil {
+				// and nothing after it
+				if _, err := decoder.Token(); err == io.EOF {
+					l.json = fields
+				}
+			}
+		}
+		if l.json == nil {
+			notJSON.Inc()
+		}
+	}
+	return l.json
+}
+
+// logfmtFields is the line parsed as logfmt, or nil if it isn't.
+func (l *inputLine) logfmtFields() map[string]string {
+	if !l.logfmtParsed {
+		l.logfmtParsed = true
+		l.logfmt = parseLogfmt(l.text)
+	}
+	return l.logfmt
+}
+
+// matchFields pulls the metric's fields out of a JSON or logfmt line,
+// returning them the same way as a regex match so the value and
+// labels can be found the same way. Lines that can't be parsed don't
+// match, but a field that's missing is left out of the groups, so it
+// counts as a missing group just like it would for a regex.
+func (m *Metric) matchFields(line *inputLine) ([]string, map[string]int) {
+	var find func(path string) (string, bool)
+	if m.JSON {
+		fields := line.jsonFields()
+		if fields == nil {
+			return nil, nil
+		}
+		find = func(path string) (string, bool) {
+			return jsonField(fields, path)
+		}
+	} else {
+		fields := line.logfmtFields()
+		if fields == nil {
+			return nil, nil
+		}
+		find = func(key string) (string, bool) {
+			value, ok := fields[key]
+			return value, ok
+		}
+	}
+
+	// and match which of those count
+	for _, matcher := range m.Matchers {
+		value, ok := find(matcher.path)
+		if !ok || !matcher.value.MatchString(value) {
+			return nil, nil
+		}
+	}
+
+	// any regexes only pick which lines to look at
+	if len(m.Compiled) > 0 {
+		picked := false
+		for index, compiled := range m.Compiled {
+			if m.mightMatch(index, line.text) && compiled.MatchString(line.text) {
+				picked = true
+				break
+			}
+		}
+		if !picked {
+			return nil, nil
+		}
+	}
+
+	result := []string{line.text}
+	groups := m.FieldIndex
+	missing := false
+	for i, path := range m.FieldPaths {
+		value, ok := find(path)
+		if !ok {
+			// the metric's own groups are shared, so copy them
+			if !missing {
+				missing = true
+				groups = make(map[string]int, len(m.FieldIndex))
+				for name, index := range m.FieldIndex {
+					groups[name] = index
+				}
+			}
+			for name, index := range groups {
+				if index == i+1 {
+					delete(groups, name)
+				}
+			}
+		}
+		result = append(result, value)
+	}
+	return result, groups
+}
+
+// fieldMatcher is a field that has to have a particular value for
+// a JSON or logfmt metric to match the line.
+type fieldMatcher struct {
+	path  string
+	value *regexp.Regexp
+}
+
+// jsonField finds a field by its dotted path, ie "http.status".
+func jsonField(fields map[string]interface{}, path string) (string, bool) {
+	var current interface{} = fields
+	for _, key := range strings.Split(path, ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		current, ok = object[key]
+		if !ok {
+			return "", false
+		}
+	}
+
+	switch value := current.(type) {
+	case string:
+		return value, true
+	case json.Number:
+		return value.String(), true
+	case bool:
+		return strconv.FormatBool(value), true
+	case nil:
+		return "", false
+	default:
+		// objects and arrays as they were
+		data, err := json.Marshal(value)
+		return string(data), err == nil
+	}
+}
+
+// parseLogfmt splits a line like `level=info msg="all done" dur=0.42`
+// into its keys and values. A key without a value has an empty one,
+// but a line of nothing but those is just text.
+func parseLogfmt(line string) map[string]string {
+	fields := map[string]string{}
+	pairs := false
+	i := 0
+	for {
+		for i < len(line) && line[i] <= ' ' {
+			i++
+		}
+		if i >= len(line) {
+			break
+		}
+
+		start := i
+		for i < len(line) && line[i] > ' ' && line[i] != '=' && line[i] != '"' {
+			i++
+		}
+		key := line[start:i]
+		if key == "" {
+			return nil
+		}
+		if i >= len(line) || line[i] != '=' {
+			fields[key] = ""
+			continue
+		}
+		i++
+		pairs = true
+
+		if i < len(line) && line[i] == '"' {
+			//
+			// Find the closing quote, skipping escaped ones, and
+			// let strconv deal with the escapes.
+			//
+			end := i + 1
+			for end < len(line) && line[end] != '"' {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(line) {
+				return nil
+			}
+			value, err := strconv.Unquote(line[i : end+1])
+			if err != nil {
+				return nil
+			}
+			fields[key] = value
+			i = end + 1
+		} else {
+			start = i
+			for i < len(line) && line[i] > ' ' {
+				i++
+			}
+			fields[key] = line[start:i]
+		}
+	}
+
+	if !pairs {
+		return nil
+	}
+	return fields
+}
+
+// labelName turns a field's path or key into a label name, anything
+// that can't be in one becomes an underscore.
+func labelName(path string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, path)
+}
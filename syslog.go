@@ -0,0 +1,145 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the fields a syslog message's header gives us, which metrics can use
+// in their labels
+var syslogFields = []string{"severity", "facility", "hostname", "appname"}
+
+var severityNames = []string{
+	"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug",
+}
+
+var facilityNames = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+// syslogLine handles a syslog message, the message itself going
+// through the metrics like any other line with the header fields
+// along with it.
+func syslogLine(line string, out io.Writer, fields prometheus.Labels) {
+	header, message, ok := parseSyslog(line)
+	if !ok {
+		badSyslog.Inc()
+		if *debug {
+			logDebug(logFields{"line": line}, "Malformed syslog message %q", line)
+		}
+		return
+	}
+	for name, value := range fields {
+		header[name] = value
+	}
+	handleLine(message, out, header)
+}
+
+// parseSyslog splits a syslog message into its header fields and the
+// message, for either RFC5424 or the older RFC3164 format.
+func parseSyslog(line string) (prometheus.Labels, string, bool) {
+	end := strings.IndexByte(line, '>')
+	if !strings.HasPrefix(line, "<") || end < 2 || end > 4 {
+		return nil, "", false
+	}
+	priority, err := strconv.Atoi(line[1:end])
+	if err != nil || priority < 0 || priority >= len(facilityNames)*8 {
+		return nil, "", false
+	}
+	header := prometheus.Labels{
+		"severity": severityNames[priority%8],
+		"facility": facilityNames[priority/8],
+		"hostname": "",
+		"appname":  "",
+	}
+	rest := line[end+1:]
+
+	//
+	// RFC5424 is <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID
+	// STRUCTURED-DATA MSG, with - for anything missing.
+	//
+	if strings.HasPrefix(rest, "1 ") {
+		parts := strings.SplitN(rest[2:], " ", 6)
+		if len(parts) < 5 {
+			return nil, "", false
+		}
+		if parts[1] != "-" {
+			header["hostname"] = parts[1]
+		}
+		if parts[2] != "-" {
+			header["appname"] = parts[2]
+		}
+		if len(parts) < 6 {
+			return header, "", true
+		}
+		message, ok := skipStructuredData(parts[5])
+		if !ok {
+			return nil, "", false
+		}
+		// the message can start with a UTF-8 BOM
+		return header, strings.TrimPrefix(message, "\xef\xbb\xbf"), true
+	}
+
+	//
+	// RFC3164 is <PRI>Mmm dd hh:mm:ss HOSTNAME TAG: MSG, the tag
+	// usually being the app name with the pid in brackets.
+	//
+	if len(rest) < len(time.Stamp)+1 || rest[len(time.Stamp)] != ' ' {
+		return nil, "", false
+	}
+	_, err = time.Parse(time.Stamp, rest[:len(time.Stamp)])
+	if err != nil {
+		return nil, "", false
+	}
+	rest = rest[len(time.Stamp)+1:]
+
+	space := strings.IndexByte(rest, ' ')
+	if space == -1 {
+		header["hostname"] = rest
+		return header, "", true
+	}
+	header["hostname"] = rest[:space]
+	rest = rest[space+1:]
+
+	space = strings.IndexByte(rest, ' ')
+	if space == -1 {
+		space = len(rest)
+	}
+	tag := rest[:space]
+	if strings.HasSuffix(tag, ":") || strings.Contains(tag, "[") {
+		tag = strings.TrimSuffix(tag, ":")
+		if i := strings.IndexByte(tag, '['); i != -1 {
+			tag = tag[:i]
+		}
+		header["appname"] = tag
+		rest = strings.TrimPrefix(rest[space:], " ")
+	}
+	return header, rest, true
+}
+
+// skipStructuredData skips over the structured data of an RFC5424
+// message to the message itself.
+func skipStructuredData(data string) (string, bool) {
+	if strings.HasPrefix(data, "-") {
+		return strings.TrimPrefix(data[1:], " "), true
+	}
+	for strings.HasPrefix(data, "[") {
+		i := 1
+		for i < len(data) && data[i] != ']' {
+			if data[i] == '\\' {
+				i++
+			}
+			i++
+		}
+		if i >= len(data) {
+			return "", false
+		}
+		data = data[i+1:]
+	}
+	return strings.TrimPrefix(data, " "), true
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// timestampedGauge is a gauge whose samples carry the time the line
+// they came from says it was, rather than the time of the scrape.
+type timestampedGauge struct {
+	desc   *prometheus.Desc
+	labels []string
+
+	lock   sync.Mutex
+	series map[string]*timestampedSample
+}
+
+type timestampedSample struct {
+	labelValues []string
+	value       float64
+	at          time.Time
+}
+
+func newTimestampedGauge(opts prometheus.GaugeOpts, labels []string) *timestampedGauge {
+	return &timestampedGauge{
+		desc:   prometheus.NewDesc(opts.Name, opts.Help, labels, opts.ConstLabels),
+		labels: labels,
+		series: map[string]*timestampedSample{},
+	}
+}
+
+func (g *timestampedGauge) Describe(ch chan<- *prometheus.Desc) {
+	ch <- g.desc
+}
+
+func (g *timestampedGauge) Collect(ch chan<- prometheus.Metric) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for _, sample := range g.series {
+		metric := prometheus.MustNewConstMetric(g.desc, prometheus.GaugeValue,
+			sample.value, sample.labelValues...)
+		ch <- prometheus.NewMetricWithTimestamp(sample.at, metric)
+	}
+}
+
+// update sets the gauge, or moves it by the value if add is set. The
+// timestamp is whatever the latest line said.
+func (g *timestampedGauge) update(labels prometheus.Labels, value float64, add bool, at time.Time) {
+	labelValues := make([]string, len(g.labels))
+	for index, name := range g.labels {
+		labelValues[index] = labels[name]
+	}
+	key := labelsKey(labels)
+	if len(g.labels) == 0 {
+		key = ""
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	sample, ok := g.series[key]
+	if !ok {
+		sample = &timestampedSample{labelValues: labelValues}
+		g.series[key] = sample
+	}
+	if add {
+		sample.value += value
+	} else {
+		sample.value = value
+	}
+	sample.at = at
+}
+
+// Delete removes a series, for when it has gone stale.
+func (g *timestampedGauge) Delete(labels prometheus.Labels) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	key := labelsKey(labels)
+	_, ok := g.series[key]
+	delete(g.series, key)
+	return ok
+}
+
+// getTimestamp finds the named timestamp in the results and parses
+// it with the layout, "unix" being seconds since the epoch.
+func getTimestamp(name string,
+	layout string,
+	groups map[string]int,
+	results []string) (time.Time, error) {
+
+	idx, ok := groups[name]
+	if !ok {
+		return time.Time{}, errMissingGroup
+	}
+
+	if layout == "unix" {
+		seconds, err := strconv.ParseFloat(results[idx], 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(0, int64(seconds*1e9)), nil
+	}
+	return time.Parse(layout, results[idx])
+}
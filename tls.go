@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// loadTLS reads the certificate, key and client CAs the config names
+// into it, so anything wrong with them is found when the config is
+// loaded rather than when someone tries to scrape us.
+func (c *Data) loadTLS() error {
+	c.certificate = nil
+	c.clientCAs = nil
+	if c.TLSCertFile == "" && c.TLSKeyFile == "" {
+		if c.TLSClientCAFile != "" {
+			return fmt.Errorf("tlsClientCAFile needs tlsCertFile and tlsKeyFile")
+		}
+		return nil
+	}
+	if c.TLSCertFile == "" || c.TLSKeyFile == "" {
+		return fmt.Errorf("tlsCertFile and tlsKeyFile go together")
+	}
+
+	certificate, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate %s and key %s, %v",
+			c.TLSCertFile, c.TLSKeyFile, err)
+	}
+	c.certificate = &certificate
+
+	if c.TLSClientCAFile != "" {
+		data, err := ioutil.ReadFile(c.TLSClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read TLS client CAs, %v", err)
+		}
+		c.clientCAs = x509.NewCertPool()
+		if !c.clientCAs.AppendCertsFromPEM(data) {
+			return fmt.Errorf("failed to load TLS client CAs, no certificates in %s", c.TLSClientCAFile)
+		}
+	}
+	return nil
+}
+
+// tlsConfig is for serving with whichever certificate and client CAs
+// are in the running config, so they can be changed with a reload.
+func tlsConfig() *tls.Config {
+	current := func() *tls.Config {
+		cnfLock.RLock()
+		defer cnfLock.RUnlock()
+		config := &tls.Config{
+			Certificates: []tls.Certificate{*cnf.certificate},
+			MinVersion:   tls.VersionTLS12,
+		}
+		if cnf.clientCAs != nil {
+			config.ClientCAs = cnf.clientCAs
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		return config
+	}
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return current(), nil
+		},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &current().Certificates[0], nil
+		},
+	}
+}
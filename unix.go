@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listen binds to where we serve, a host and port or a unix socket
+// given as unix:///path/to.sock. A socket left behind by an earlier
+// run is removed first and the new one is given mode, which is
+// octal. Closing the listener removes the socket.
+func listen(address string, mode string) (net.Listener, error) {
+	if !strings.HasPrefix(address, "unix://") {
+		return net.Listen("tcp", address)
+	}
+
+	path := strings.TrimPrefix(address, "unix://")
+	info, err := os.Lstat(path)
+	if err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s is there and isn't a socket", path)
+		}
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != "" {
+		perm, _ := strconv.ParseUint(mode, 8, 32)
+		err = os.Chmod(path, os.FileMode(perm))
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
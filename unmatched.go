@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// lineRing keeps the last few lines added to it, for showing examples
+// of lines that didn't match anything.
+type lineRing struct {
+	sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+// the last unmatched lines, nil unless -debug-unmatched is set
+var unmatchedRing *lineRing
+
+func newLineRing(size int) *lineRing {
+	return &lineRing{lines: make([]string, size)}
+}
+
+// add keeps the line, pushing out the oldest once the ring is full.
+func (r *lineRing) add(line string) {
+	r.Lock()
+	defer r.Unlock()
+	r.lines[r.next] = line
+	r.next++
+	if r.next == len(r.lines) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// ServeHTTP writes out the lines kept, oldest first.
+func (r *lineRing) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.Lock()
+	lines := append([]string(nil), r.lines[:r.next]...)
+	if r.full {
+		lines = append(append([]string(nil), r.lines[r.next:]...), lines...)
+	}
+	r.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"runtime"
+)
+
+// Filled in when building, ie
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse --short HEAD)"
+//
+// which the Makefile does from git.
+var (
+	version = "dev"
+	commit  = "unknown"
+)
+
+var buildInfo = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "stdout2prom_build_info",
+		Help: "Always 1, labelled with the version of stdout2prom that's running",
+	},
+	[]string{"version", "commit", "goversion"},
+)
+
+// versionString is what -version prints.
+func versionString() string {
+	return fmt.Sprintf("stdout2prom version %s, commit %s, built with %s",
+		version, commit, runtime.Version())
+}
+
+// registerBuildInfo sets up stdout2prom_build_info.
+func registerBuildInfo() {
+	buildInfo.WithLabelValues(version, commit, runtime.Version()).Set(1)
+	prometheus.MustRegister(buildInfo)
+}
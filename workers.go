@@ -0,0 +1,94 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+	"sync/atomic"
+)
+
+// matchJob is a line to run against some of the metrics.
+type matchJob struct {
+	line    string
+	metrics []Metric
+	fields  prometheus.Labels
+	matched *int32
+	keep    *int32
+	done    *sync.WaitGroup
+}
+
+// where matchers wait for work, nil if we match one metric at a time
+var matchJobs chan matchJob
+
+// startMatchers starts n goroutines which share out the metrics each
+// line is run against.
+func startMatchers(n int) {
+	if n < 2 {
+		return
+	}
+	matchJobs = make(chan matchJob, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			for job := range matchJobs {
+				matched, keep := matchAll(job.line, job.metrics, job.fields)
+				if matched {
+					atomic.StoreInt32(job.matched, 1)
+				}
+				if keep {
+					atomic.StoreInt32(job.keep, 1)
+				}
+				job.done.Done()
+			}
+		}()
+	}
+}
+
+// matchMetrics runs a line against the metrics, returning whether
+// any of them matched and whether any that did want the line kept
+// rather than eaten. With lots of metrics they're split between the
+// matchers, each metric is still only looked at by one of them so
+// every metric sees the lines in order.
+func matchMetrics(line string, metrics []Metric, fields prometheus.Labels) (bool, bool) {
+	// not worth it for less than a handful of metrics each
+	shares := len(metrics) / 4
+	if shares > cap(matchJobs) {
+		shares = cap(matchJobs)
+	}
+	if shares < 2 {
+		return matchAll(line, metrics, fields)
+	}
+
+	var matched, keep int32
+	var done sync.WaitGroup
+	done.Add(shares)
+	for i := 0; i < shares; i++ {
+		matchJobs <- matchJob{
+			line:    line,
+			metrics: metrics[i*len(metrics)/shares : (i+1)*len(metrics)/shares],
+			fields:  fields,
+			matched: &matched,
+			keep:    &keep,
+			done:    &done,
+		}
+	}
+	done.Wait()
+	return matched == 1, keep == 1
+}
+
+// matchAll runs a line against each of the metrics in turn, until
+// one that matches says to stop.
+func matchAll(line string, metrics []Metric, fields prometheus.Labels) (bool, bool) {
+	in := &inputLine{text: line}
+	matched, keep := false, false
+	for index := range metrics {
+		if matchMetric(&metrics[index], in, fields) {
+			matched = true
+			if !metrics[index].Eat {
+				keep = true
+			}
+			if metrics[index].Stop {
+				break
+			}
+		}
+	}
+	return matched, keep
+}